@@ -0,0 +1,544 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	sortByName     = "name"
+	sortByModified = "modified"
+)
+
+var (
+	archiveExtsFlag = flag.String("archive-exts", zipSuffix, "comma separated extensions of the links taken as archives, case insensitive, e.g. .zip,.tar.gz,.tgz; the archive format is told from the contents")
+	sortEntries     = flag.String("sort-entries", "", "push zip entries sorted by name or modified time instead of in archive order; tarballs are always pushed in archive order")
+	entryPattern    = flag.String("entry-pattern", "", "only push archive entries whose name matches this regular expression")
+)
+
+// archiveExts are the lowercase extensions in -archive-exts, set up by
+// parseArchiveExts.
+var archiveExts = []string{zipSuffix}
+
+// parseArchiveExts sets archiveExts up from -archive-exts.
+func parseArchiveExts() error {
+	var exts []string
+	for _, ext := range strings.Split(*archiveExtsFlag, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("invalid archive extension %q", ext)
+		}
+		exts = append(exts, ext)
+	}
+	archiveExts = exts
+	return nil
+}
+
+// hasArchiveExt reports whether name ends in one of -archive-exts.
+func hasArchiveExt(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryFilter is -entry-pattern compiled by compileEntryPattern, nil when
+// every entry is pushed.
+var entryFilter *regexp.Regexp
+
+// compileEntryPattern sets entryFilter up from -entry-pattern.
+func compileEntryPattern() error {
+	if *entryPattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(*entryPattern)
+	if err != nil {
+		return fmt.Errorf("invalid -entry-pattern: %v", err)
+	}
+	entryFilter = re
+	return nil
+}
+
+// archiveFormat identifies the kind of a downloaded archive.
+type archiveFormat int
+
+const (
+	formatUnknown archiveFormat = iota
+	formatZip
+	formatTarGz
+)
+
+// errUnrecognizedFormat is wrapped by the error returned when a download
+// is not an archive format we can extract.
+var errUnrecognizedFormat = errors.New("unrecognized format")
+
+// zipFlagEncrypted is the general purpose flag bit set on encrypted zip
+// entries.
+const zipFlagEncrypted = 0x1
+
+// encryptedQueue records the keys of encrypted entries, which are skipped.
+const encryptedQueue = "encrypted"
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	// tarMagic is at tarMagicOffset of the first header of ustar and GNU
+	// tarballs.
+	tarMagic = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// detectFormat sniffs the first bytes of the file at path to tell which
+// kind of archive it is, regardless of the name it was served under.
+func detectFormat(path string) (archiveFormat, error) {
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return formatUnknown, err
+	}
+	defer fd.Close()
+	head := make([]byte, 4)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return formatUnknown, err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, zipMagic), bytes.HasPrefix(head, emptyZipMagic):
+		return formatZip, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		// a plain gzipped file is not a tarball.
+		gz, err := gzip.NewReader(io.MultiReader(bytes.NewReader(head), fd))
+		if err != nil {
+			return formatUnknown, nil
+		}
+		defer gz.Close()
+		header := make([]byte, tarMagicOffset+len(tarMagic))
+		if _, err := io.ReadFull(gz, header); err != nil {
+			return formatUnknown, nil
+		}
+		if bytes.Equal(header[tarMagicOffset:], tarMagic) {
+			return formatTarGz, nil
+		}
+	}
+	return formatUnknown, nil
+}
+
+// processFile pushes the entries of the archive at path into redis, using
+// the extractor for the format its contents have.
+func processFile(ctx context.Context, path, zipName string, c redis.Conn) error {
+	format, err := detectFormat(path)
+	if err != nil {
+		return &ArchiveError{Zip: zipName, Op: "cannot read archive format", Err: err}
+	}
+	if format != formatUnknown {
+		if ctx, err = withEntryIndex(ctx, c, zipName); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case formatZip:
+		return processZip(ctx, path, zipName, c)
+	case formatTarGz:
+		return processTarGz(ctx, path, zipName, c)
+	}
+	return &ArchiveError{Zip: zipName, Op: "cannot process archive", Err: errUnrecognizedFormat}
+}
+
+// processZip opens a zipfile in the given path and logs its conents a
+// list in the given redis connection.
+func processZip(ctx context.Context, zipFile, zipName string, c redis.Conn) error {
+	log.Printf("Processing zip %s", zipName)
+	started := time.Now()
+	r, closer, err := openZipFile(zipFile)
+	runStats.timed("zip.open", time.Since(started))
+	if err != nil {
+		return &ArchiveError{Zip: zipName, Op: fmt.Sprintf("cannot open zip file %q", zipFile), Err: err}
+	}
+	defer closer.Close()
+	return processArchive(ctx, r, zipName, c)
+}
+
+// processArchive pushes every entry of the given zip that was not
+// processed yet into redis.
+func processArchive(ctx context.Context, r *zip.Reader, zipName string, c redis.Conn) (err error) {
+	ctx, span := tracer.Start(ctx, "extract", trace.WithAttributes(
+		attribute.String("zip", zipName),
+		attribute.Int("zip.entries", len(r.File)),
+	))
+	pushed, skipped := 0, 0
+	defer func() {
+		span.SetAttributes(attribute.Int("zip.pushed", pushed))
+		endSpan(span, err)
+	}()
+	defer func() {
+		if err == nil {
+			err = saveEntryCounts(ctx, c, zipName, entryCounts{Entries: len(r.File), Pushed: pushed, Skipped: skipped})
+		}
+	}()
+
+	if *verboseZip {
+		defer logZipStats(r, zipName)
+	}
+	if len(r.File) == 0 {
+		log.Printf("Zip %s has no entries, nothing to push", zipName)
+		return nil
+	}
+	names := newArchiveNames(zipName)
+	for _, f := range sortedEntries(r.File) {
+		if err := checkEntryLimit(zipName, pushed); err != nil {
+			return err
+		}
+		name := names.unique(f.Name)
+		if modifiedBefore(name, f.Modified) {
+			skipped++
+			continue
+		}
+		if f.Flags&zipFlagEncrypted != 0 {
+			if err := skipEncrypted(ctx, c, zipName, name); err != nil {
+				return err
+			}
+			skipped++
+			continue
+		}
+		ok, err := processEntry(ctx, zipName, name, int64(f.UncompressedSize64), f.Open, c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			pushed++
+		} else {
+			skipped++
+		}
+	}
+	return nil
+}
+
+// processTarGz opens a gzipped tarball in the given path and pushes its
+// regular files like processArchive does for zip entries.
+func processTarGz(ctx context.Context, path, zipName string, c redis.Conn) (err error) {
+	log.Printf("Processing tarball %s", zipName)
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return &ArchiveError{Zip: zipName, Op: fmt.Sprintf("cannot open tarball %q", path), Err: err}
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return &ArchiveError{Zip: zipName, Op: "cannot decompress tarball", Err: err}
+	}
+	defer gz.Close()
+
+	ctx, span := tracer.Start(ctx, "extract", trace.WithAttributes(attribute.String("zip", zipName)))
+	entries, pushed, skipped := 0, 0, 0
+	defer func() {
+		span.SetAttributes(attribute.Int("zip.pushed", pushed))
+		endSpan(span, err)
+	}()
+	defer func() {
+		if err == nil {
+			err = saveEntryCounts(ctx, c, zipName, entryCounts{Entries: entries, Pushed: pushed, Skipped: skipped})
+		}
+	}()
+
+	tr := tar.NewReader(gz)
+	names := newArchiveNames(zipName)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if entries == 0 {
+				log.Printf("Tarball %s has no files, nothing to push", zipName)
+			}
+			return nil
+		}
+		if err != nil {
+			return &ArchiveError{Zip: zipName, Op: "cannot read tarball", Err: err}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := checkEntryLimit(zipName, pushed); err != nil {
+			return err
+		}
+		entries++
+		name := names.unique(hdr.Name)
+		if modifiedBefore(name, hdr.ModTime) {
+			skipped++
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }
+		ok, err := processEntry(ctx, zipName, name, hdr.Size, open, c)
+		if err != nil {
+			return err
+		}
+		if ok {
+			pushed++
+		} else {
+			skipped++
+		}
+	}
+}
+
+// sortedEntries returns files in the order selected by -sort-entries.
+func sortedEntries(files []*zip.File) []*zip.File {
+	var less func(a, b *zip.File) bool
+	switch *sortEntries {
+	case sortByName:
+		less = func(a, b *zip.File) bool { return a.Name < b.Name }
+	case sortByModified:
+		less = func(a, b *zip.File) bool { return a.Modified.Before(b.Modified) }
+	default:
+		return files
+	}
+	sorted := make([]*zip.File, len(files))
+	copy(sorted, files)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	return sorted
+}
+
+// processEntry pushes the entry with the given name in the given zip into
+// redis unless it was already processed, reporting whether it was pushed.
+// The entry is only opened when it needs to be pushed. size is the size of
+// the entry contents as declared by the archive, -1 if unknown.
+func processEntry(ctx context.Context, zipName, name string, size int64, open func() (io.ReadCloser, error), c redis.Conn) (bool, error) {
+	if entryFilter != nil && !entryFilter.MatchString(name) {
+		debugf("Skipping xml %s, it does not match -entry-pattern", name)
+		atomic.AddInt64(&runStats.entriesSkipped, 1)
+		return false, nil
+	}
+	log.Printf("Processing xml %s", name)
+	key := entryKey(archiveKeyOf(ctx, zipName), dedupName(name))
+	if !*force {
+		processed, err := entryProcessed(ctx, c, zipName, outputName(name), key)
+		if err != nil {
+			return false, err
+		}
+		if processed {
+			atomic.AddInt64(&runStats.entriesSkipped, 1)
+			return false, nil
+		}
+	}
+	if err := pushEntry(ctx, zipName, name, key, size, open, c); err != nil {
+		if errors.Is(err, errTransformSkipped) || errors.Is(err, errUnroutable) {
+			log.Printf("Skipping xml %s: %v", name, err)
+			atomic.AddInt64(&runStats.entriesSkipped, 1)
+			return false, nil
+		}
+		if errors.Is(err, errQueueFull) {
+			return false, err
+		}
+		atomic.AddInt64(&runStats.entriesFailed, 1)
+		return false, err
+	}
+	runProgress.entryPushed()
+	metrics.count("xmls.pushed", 1)
+	return true, nil
+}
+
+// skipEncrypted records that the named entry of the given zip is
+// encrypted and was skipped, archive/zip cannot decrypt it.
+func skipEncrypted(ctx context.Context, c redis.Conn, zipName, name string) error {
+	log.Printf("Skipping xml %s of zip %s: encrypted", name, zipName)
+	atomic.AddInt64(&runStats.entriesSkipped, 1)
+	if _, err := c.Do("HSET", feedOf(ctx).key(encryptedQueue), entryKey(archiveKeyOf(ctx, zipName), dedupName(name)), zipName); err != nil {
+		return &StoreError{Op: "cannot record encrypted xml", Err: err}
+	}
+	return nil
+}
+
+// entryProcessed reports whether the named entry of the given zip of the
+// feed in ctx, recorded under key, was already pushed. Sinks that keep
+// track of it themselves are asked instead of redis, and with -entry-index
+// the index of the zip is asked before the processed hash.
+func entryProcessed(ctx context.Context, c redis.Conn, zipName, name, key string) (bool, error) {
+	f := feedOf(ctx)
+	if d, ok := sinkOf(ctx).(deduper); ok {
+		delivered, err := d.Delivered(Entry{Zip: zipName, Name: name, Feed: f})
+		if err != nil {
+			return false, &StoreError{Op: "cannot check if xml was delivered", Err: err}
+		}
+		return delivered, nil
+	}
+	index := entryIndexOf(ctx)
+	if index[key] {
+		return true, nil
+	}
+	// the hash stays authoritative for xmls indexed by no run yet.
+	processed, err := hashHas(c, f.key(processedQueue), key)
+	if err != nil {
+		return false, &StoreError{Op: "cannot check if xml exists", Err: err}
+	}
+	if processed && index != nil {
+		if err := indexEntry(c, f, zipName, key); err != nil {
+			return false, err
+		}
+	}
+	return processed, nil
+}
+
+// pushEntry pushes the contents of the named entry into redis and records
+// it as processed under key.
+func pushEntry(ctx context.Context, zipName, name, key string, size int64, open func() (io.ReadCloser, error), c redis.Conn) (err error) {
+	_, span := tracer.Start(ctx, "push", trace.WithAttributes(attribute.String("entry", name)))
+	defer func() { endSpan(span, err) }()
+
+	if _, streams := sinkOf(ctx).(streamer); !*entrySpool || !streams {
+		reserved := entryMemory.acquire(prefixSize(size))
+		defer entryMemory.release(reserved)
+	}
+	fd, err := open()
+	if err != nil {
+		return &ArchiveError{Zip: zipName, Entry: name, Op: "cannot open xml on zip", Err: err}
+	}
+	defer fd.Close()
+	f := feedOf(ctx)
+	e := Entry{Zip: zipName, Name: outputName(name), Feed: f}
+	truncated := false
+	if *entrySpool {
+		e, err = pushSpooled(ctx, c, e, fd)
+	} else {
+		e, truncated, err = pushBuffered(ctx, c, span, e, name, size, fd)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.Do("HSET", f.key(processedQueue), key, name)
+	if err != nil {
+		return &StoreError{Op: "cannot set processed Queue", Err: err}
+	}
+	if err := indexEntry(c, f, zipName, key); err != nil {
+		return err
+	}
+	if err := verifyWrite(ctx, c, e, key); err != nil {
+		return err
+	}
+	if truncated {
+		debugf("Pushed the first %d bytes of xml %s", *entryPrefixBytes, name)
+		if _, err := c.Do("HSET", f.key(truncatedQueue), key, size); err != nil {
+			return &StoreError{Op: "cannot record truncated xml", Err: err}
+		}
+	}
+	return nil
+}
+
+// pushBuffered reads the named entry from r into memory, transforms and
+// routes it and pushes it as e, reporting whether it was cut to
+// -entry-prefix-bytes. It returns e as pushed.
+func pushBuffered(ctx context.Context, c redis.Conn, span trace.Span, e Entry, name string, size int64, r io.Reader) (Entry, bool, error) {
+	var (
+		data      []byte
+		truncated bool
+		err       error
+	)
+	started := time.Now()
+	if *entryPrefixBytes > 0 {
+		data, truncated, err = readPrefix(r, *entryPrefixBytes)
+	} else {
+		data, err = readEntry(r, size)
+	}
+	runStats.timed("entry.read", time.Since(started))
+	if err != nil {
+		return e, false, &ArchiveError{Zip: e.Zip, Entry: name, Op: "cannot read xml in zip", Err: err}
+	}
+	if data, err = transformEntry(name, data); err != nil {
+		return e, false, &ArchiveError{Zip: e.Zip, Entry: name, Op: "cannot transform xml", Err: err}
+	}
+	span.SetAttributes(attribute.Int("entry.bytes", len(data)))
+	queue, err := routeEntry(name, data)
+	if err != nil {
+		return e, false, &ArchiveError{Zip: e.Zip, Entry: name, Op: "cannot route xml", Err: err}
+	}
+	e.Data, e.Queue, e.RouteKey = data, queue, routeKey(name, data)
+	if err := waitForQueue(ctx, c, e); err != nil {
+		return e, false, err
+	}
+	started = time.Now()
+	err = sinkOf(ctx).Push(c, e)
+	runStats.timed("push", time.Since(started))
+	if err != nil {
+		return e, false, &StoreError{Op: "cannot push xml", Err: err}
+	}
+	return e, truncated, nil
+}
+
+// maxPreallocSize bounds the entry size trusted from the archive directory
+// when reading, larger entries are read into a growing buffer so a bogus
+// size cannot make us allocate it up front.
+const maxPreallocSize = 64 << 20
+
+// readEntry reads the whole contents of an entry. When its size is known
+// it is read straight into a buffer of that size instead of being copied
+// through a growing one.
+func readEntry(r io.Reader, size int64) ([]byte, error) {
+	if size >= 0 && size <= maxPreallocSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		// reading up to the end is what makes zip entries verify their
+		// checksum, and catches entries longer than declared.
+		var extra [1]byte
+		if _, err := io.ReadFull(r, extra[:]); err != io.EOF {
+			if err == nil {
+				err = errors.New("entry is longer than its declared size")
+			}
+			return nil, err
+		}
+		return data, nil
+	}
+	var buf bytes.Buffer
+	writer := bufio.NewWriter(&buf)
+	if _, err := io.Copy(writer, r); err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	return buf.Bytes(), nil
+}
+
+// logZipStats logs the size of the given zip as recorded in its directory,
+// entries are not read.
+func logZipStats(r *zip.Reader, zipName string) {
+	var compressed, uncompressed uint64
+	for _, f := range r.File {
+		compressed += f.CompressedSize64
+		uncompressed += f.UncompressedSize64
+	}
+	ratio := 0.0
+	if compressed > 0 {
+		ratio = float64(uncompressed) / float64(compressed)
+	}
+	log.Printf("Zip %s has %d entries, %d bytes compressed, %d bytes uncompressed, %.2f compression ratio",
+		zipName, len(r.File), compressed, uncompressed, ratio)
+}
+
+// entryKey returns the key under which the entry with the given name in
+// the zip recorded under zipKey is recorded as processed.
+func entryKey(zipKey, entryName string) string {
+	if *legacyEntryKeys {
+		return entryName
+	}
+	return strings.NewReplacer("{zip}", zipKey, "{entry}", entryName).Replace(*entryKeyFormat)
+}
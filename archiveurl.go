@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var archiveURLTemplate = flag.String("archive-url-template", "", "url relative links to zips are downloaded from, for feeds with query based download endpoints, as in https://host/get?file={link}; {link} is replaced by the query escaped link and {path} by the link as is. By default links are resolved against the feed")
+
+// checkArchiveURLTemplate returns an error if -archive-url-template is not
+// an absolute url taking the link.
+func checkArchiveURLTemplate() error {
+	if *archiveURLTemplate == "" {
+		return nil
+	}
+	if !strings.Contains(*archiveURLTemplate, "{link}") && !strings.Contains(*archiveURLTemplate, "{path}") {
+		return fmt.Errorf("-archive-url-template must contain {link} or {path}")
+	}
+	u, err := url.Parse(expandArchiveURL("x"))
+	if err != nil {
+		return fmt.Errorf("invalid -archive-url-template: %v", err)
+	}
+	if !u.IsAbs() {
+		return fmt.Errorf("-archive-url-template must be an absolute url")
+	}
+	return nil
+}
+
+// archiveURL returns the url to download link of feed f from. Absolute
+// links are used as they are, relative ones go through
+// -archive-url-template or are resolved against the feed as a directory.
+func archiveURL(f *Feed, link string) string {
+	feedURL := feed
+	if f != nil {
+		feedURL = f.URL
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return strings.TrimSuffix(feedURL, "/") + "/" + link
+	}
+	if ref.IsAbs() {
+		return link
+	}
+	if *archiveURLTemplate != "" {
+		return expandArchiveURL(link)
+	}
+	base, err := url.Parse(feedURL)
+	if err != nil {
+		return strings.TrimSuffix(feedURL, "/") + "/" + link
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		// the feed is the directory of its zips, not a page within it.
+		base.Path += "/"
+		base.RawPath = ""
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// expandArchiveURL returns -archive-url-template taking link.
+func expandArchiveURL(link string) string {
+	return strings.NewReplacer("{link}", url.QueryEscape(link), "{path}", link).Replace(*archiveURLTemplate)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	queueFullBlock   = "block"
+	queueFullRequeue = "requeue"
+
+	// requeuedQueue records links that were left for a later run because
+	// the output queue was full.
+	requeuedQueue = "requeued"
+
+	// queuePollInterval is how often a blocked worker checks whether the
+	// output queue drained.
+	queuePollInterval = 5 * time.Second
+)
+
+var (
+	maxQueueLen     = flag.Int64("max-queue-len", 0, "hold off pushing xmls while the output queue each goes to, after -type-queues, -route-element-queue and -shards, is longer than this, 0 for no limit")
+	queueLowWater   = flag.Int64("queue-low-water", 0, "length the output queue has to drain below before a blocked crawl goes on, 0 for half of -max-queue-len")
+	queueFullPolicy = flag.String("queue-full-policy", queueFullBlock, "what to do with a zip whose next xml goes to an output queue over -max-queue-len: block until it drains, or requeue to leave the rest of the zip for a later run")
+)
+
+// backlogger is implemented by sinks that can tell how many delivered
+// entries are still waiting for consumers: Backlog in the longest shard of
+// the queue of a feed, QueueLen in the very queue an entry is pushed to.
+type backlogger interface {
+	Backlog(c redis.Conn, f *Feed) (int64, error)
+	QueueLen(c redis.Conn, e Entry) (int64, error)
+}
+
+func (listSink) Backlog(c redis.Conn, f *Feed) (int64, error) {
+	return longestShard(c, "LLEN", f, f.queue(*outputQueue))
+}
+
+func (listSink) QueueLen(c redis.Conn, e Entry) (int64, error) {
+	return redis.Int64(c.Do("LLEN", shardKey(e.queue(*outputQueue), e)))
+}
+
+func (streamSink) Backlog(c redis.Conn, f *Feed) (int64, error) {
+	return longestShard(c, "XLEN", f, f.queue(*streamKey))
+}
+
+func (streamSink) QueueLen(c redis.Conn, e Entry) (int64, error) {
+	return redis.Int64(c.Do("XLEN", shardKey(e.queue(*streamKey), e)))
+}
+
+// longestShard returns the length of the longest shard of base in feed f,
+// as told by the given length command.
+func longestShard(c redis.Conn, lenCmd string, f *Feed, base string) (int64, error) {
+	var longest int64
+	for _, key := range shardNames(f, base) {
+		n, err := redis.Int64(c.Do(lenCmd, key))
+		if err != nil {
+			return 0, err
+		}
+		if n > longest {
+			longest = n
+		}
+	}
+	return longest, nil
+}
+
+// checkQueuePolicy returns an error if the -max-queue-len settings cannot
+// be applied to the selected sink.
+func checkQueuePolicy() error {
+	if *maxQueueLen <= 0 {
+		return nil
+	}
+	switch *queueFullPolicy {
+	case queueFullBlock, queueFullRequeue:
+	default:
+		return fmt.Errorf("unknown queue full policy %q", *queueFullPolicy)
+	}
+	if _, ok := output.(backlogger); !ok {
+		return fmt.Errorf("-max-queue-len is not supported by sink %q", *sinkType)
+	}
+	if *queueLowWater > *maxQueueLen {
+		return fmt.Errorf("-queue-low-water %d is over -max-queue-len %d", *queueLowWater, *maxQueueLen)
+	}
+	return nil
+}
+
+// errQueueFull is wrapped by the errors of entries not pushed because
+// their output queue is over -max-queue-len, their zip is left for later.
+var errQueueFull = errors.New("output queue is full")
+
+// waitForQueue checks the output queue e is pushed to, routed and sharded
+// as the sink does, before pushing it. With the requeue policy it returns
+// errQueueFull if the queue is over -max-queue-len, with the block policy
+// it waits instead until the queue drains below the low-water mark, or
+// until ctx is done.
+func waitForQueue(ctx context.Context, c redis.Conn, e Entry) error {
+	b, ok := sinkOf(ctx).(backlogger)
+	if !ok || *maxQueueLen <= 0 {
+		return nil
+	}
+	length, err := b.QueueLen(c, e)
+	if err != nil {
+		return &StoreError{Op: "cannot get output queue length", Err: err}
+	}
+	if length <= *maxQueueLen {
+		return nil
+	}
+	if *queueFullPolicy == queueFullRequeue {
+		return fmt.Errorf("%w, it holds %d xmls", errQueueFull, length)
+	}
+	lowWater := *queueLowWater
+	if lowWater == 0 {
+		lowWater = *maxQueueLen / 2
+	}
+	log.Printf("Output queue of xml %s holds %d xmls, waiting for it to drain below %d", e.Name, length, lowWater)
+	for length >= lowWater {
+		select {
+		case <-time.After(queuePollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("%w, stopped waiting for it to drain", errQueueFull)
+		}
+		if length, err = b.QueueLen(c, e); err != nil {
+			return &StoreError{Op: "cannot get output queue length", Err: err}
+		}
+	}
+	log.Printf("Output queue drained to %d xmls, going on", length)
+	return nil
+}
+
+// requeueZip records that the zip at link of feed f was left for a later
+// run because an output queue it pushes to is full.
+func requeueZip(c redis.Conn, f *Feed, link string) error {
+	atomic.AddInt64(&runStats.requeued, 1)
+	if _, err := c.Do("HSET", f.key(requeuedQueue), link, time.Now().Unix()); err != nil {
+		return &StoreError{Op: "cannot record requeued zip", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveCache keeps downloaded archives on disk until they have been
+// fully processed so a retry can skip the download and only extract the
+// entries that were not processed yet. Archives handed out by get and put
+// are pinned, and never evicted, until given back with remove or release.
+type archiveCache struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu sync.Mutex
+	// pinned counts the holders of each archive in use, by path.
+	pinned map[string]int
+}
+
+// newArchiveCache returns a cache rooted at dir, creating it if needed and
+// evicting whatever exceeds the given limits.
+func newArchiveCache(dir string, maxBytes int64, maxAge time.Duration) (*archiveCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cache dir %q: %v", dir, err)
+	}
+	c := &archiveCache{dir: dir, maxBytes: maxBytes, maxAge: maxAge, pinned: map[string]int{}}
+	if err := c.evict(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// path returns the location of the cached archive for key, entries are
+// named after the hash of the key so any key is a valid file name.
+func (c *archiveCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+zipSuffix)
+}
+
+// get returns the path of the cached archive for key, pinned, if there is
+// one that has not expired.
+func (c *archiveCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.path(key)
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", false
+	}
+	if c.maxAge > 0 && time.Since(info.ModTime()) > c.maxAge && c.pinned[p] == 0 {
+		os.Remove(p)
+		return "", false
+	}
+	c.pinned[p]++
+	return p, true
+}
+
+// put moves the downloaded file into the cache as the archive for key and
+// returns its new path, pinned, src must be in the cache dir.
+func (c *archiveCache) put(key, src string) (string, error) {
+	c.mu.Lock()
+	p := c.path(key)
+	err := os.Rename(src, p)
+	if err == nil {
+		c.pinned[p]++
+	}
+	c.mu.Unlock()
+	if err != nil {
+		os.Remove(src)
+		return "", err
+	}
+	if err := c.evict(); err != nil {
+		log.Printf("Cannot evict cached zips: %v", err)
+	}
+	return p, nil
+}
+
+// remove drops the cached archive for key, it is called once the archive
+// has been fully processed.
+func (c *archiveCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.path(key)
+	delete(c.pinned, p)
+	os.Remove(p)
+}
+
+// release unpins the cached archive for key, keeping it for a later run.
+func (c *archiveCache) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.path(key)
+	if c.pinned[p] <= 1 {
+		delete(c.pinned, p)
+		return
+	}
+	c.pinned[p]--
+}
+
+// evict removes expired archives and then the oldest ones until the cache
+// fits in maxBytes, or only pinned archives are left.
+func (c *archiveCache) evict() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("cannot list cache dir: %v", err)
+	}
+	var kept []os.FileInfo
+	var total int64
+	for _, info := range infos {
+		// temporary files for in flight downloads share the dir.
+		if info.IsDir() || !strings.HasSuffix(info.Name(), zipSuffix) {
+			continue
+		}
+		if c.pinned[filepath.Join(c.dir, info.Name())] > 0 {
+			// in use, still taking its share of the cache.
+			total += info.Size()
+			continue
+		}
+		if c.maxAge > 0 && time.Since(info.ModTime()) > c.maxAge {
+			log.Printf("Evicting expired cached zip %s", info.Name())
+			os.Remove(filepath.Join(c.dir, info.Name()))
+			continue
+		}
+		kept = append(kept, info)
+		total += info.Size()
+	}
+	if c.maxBytes <= 0 {
+		return nil
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].ModTime().Before(kept[j].ModTime())
+	})
+	for _, info := range kept {
+		if total <= c.maxBytes {
+			break
+		}
+		log.Printf("Evicting cached zip %s to fit cache size", info.Name())
+		os.Remove(filepath.Join(c.dir, info.Name()))
+		total -= info.Size()
+	}
+	return nil
+}
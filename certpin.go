@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var feedCertPin = flag.String("feed-cert-pin", "", "sha256 fingerprints, hex and comma separated, the certificate of the feed hosts must match; applies to listing and zip downloads from those hosts, other hosts are verified as usual")
+
+// parseCertPins returns the fingerprints in -feed-cert-pin, colons and
+// case aside.
+func parseCertPins() (map[string]bool, error) {
+	pins := map[string]bool{}
+	for _, pin := range strings.Split(*feedCertPin, ",") {
+		pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+		if pin == "" {
+			continue
+		}
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q, expected a hex sha256", pin)
+		}
+		pins[pin] = true
+	}
+	return pins, nil
+}
+
+// pinnedTransport sends requests to the pinned hosts through a transport
+// checking their certificate against the pins, and the rest through base.
+// Hosts are told apart by request so the check does not depend on SNI,
+// which is not sent for ip addresses.
+type pinnedTransport struct {
+	base, pinned http.RoundTripper
+	hosts        map[string]bool
+}
+
+func (p *pinnedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !p.hosts[strings.ToLower(req.URL.Hostname())] {
+		return p.base.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("cannot check the certificate of %s over %s, it is pinned by -feed-cert-pin", req.URL.Host, req.URL.Scheme)
+	}
+	return p.pinned.RoundTrip(req)
+}
+
+// pinFeedCerts returns t made to reject connections to the hosts of feeds
+// whose certificate does not match -feed-cert-pin.
+func pinFeedCerts(t *http.Transport, feeds []*Feed) (http.RoundTripper, error) {
+	if *feedCertPin == "" {
+		return t, nil
+	}
+	pins, err := parseCertPins()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := feedHosts(feeds)
+	if err != nil {
+		return nil, err
+	}
+	pinned := t.Clone()
+	if pinned.TLSClientConfig == nil {
+		pinned.TLSClientConfig = &tls.Config{}
+	}
+	pinned.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("feed host sent no certificate")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !pins[hex.EncodeToString(sum[:])] {
+			return errors.New("certificate does not match -feed-cert-pin")
+		}
+		return nil
+	}
+	return &pinnedTransport{base: t, pinned: pinned, hosts: hosts}, nil
+}
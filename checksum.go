@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	missingChecksumProcess = "process"
+	missingChecksumFail    = "fail"
+
+	// corruptQueue records links whose download did not match their
+	// checksum, they are not marked as downloaded.
+	corruptQueue = "corrupt"
+
+	// maxSidecarSize bounds how much of a checksum file is read.
+	maxSidecarSize = 4 << 10
+)
+
+var (
+	verifyChecksums = flag.Bool("verify-checksums", false, "check every zip against the sha256 published next to it before extracting it")
+	checksumSuffix  = flag.String("checksum-suffix", ".sha256", "suffix appended to a zip url to get its sha256 file")
+	missingChecksum = flag.String("missing-checksum", missingChecksumProcess, "what to do with a zip without sha256 file: process it unverified, or fail it")
+)
+
+// errNoChecksum is returned when a zip has no checksum file.
+var errNoChecksum = errors.New("no checksum published")
+
+// checkChecksumPolicy returns an error if -missing-checksum is not a known
+// policy.
+func checkChecksumPolicy() error {
+	switch *missingChecksum {
+	case missingChecksumProcess, missingChecksumFail:
+		return nil
+	}
+	return fmt.Errorf("unknown missing checksum policy %q", *missingChecksum)
+}
+
+// verifyChecksum reports whether the local copy of the zip at link of feed
+// f matches the checksum published for it.
+func verifyChecksum(f *Feed, link, zipFile string) (bool, error) {
+	want, err := publishedChecksum(f, link)
+	if err != nil {
+		return false, err
+	}
+	fd, err := openArchiveFile(zipFile)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+// publishedChecksum returns the hex sha256 in the checksum file of the zip
+// at link of feed f, which is either the bare hash or sha256sum output.
+func publishedChecksum(f *Feed, link string) (string, error) {
+	var body []byte
+	if *localDir != "" {
+		data, err := ioutil.ReadFile(localArchive(link) + *checksumSuffix)
+		if os.IsNotExist(err) {
+			return "", errNoChecksum
+		}
+		if err != nil {
+			return "", err
+		}
+		body = data
+	} else {
+		response, err := zipClient.Get(archiveURL(f, link) + *checksumSuffix)
+		if err != nil {
+			return "", err
+		}
+		defer closeBody(response.Body)
+		if response.StatusCode == http.StatusNotFound {
+			return "", errNoChecksum
+		}
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("status %s", response.Status)
+		}
+		if body, err = ioutil.ReadAll(io.LimitReader(response.Body, maxSidecarSize)); err != nil {
+			return "", err
+		}
+	}
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file")
+	}
+	sum := strings.ToLower(fields[0])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum %q", fields[0])
+	}
+	return sum, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var configFile = flag.String("config", "", "file of name = value lines setting flags not given on the command line; on SIGHUP it is read again and debug, poll, download-workers and extract-workers are applied live, the worker count following the last two from the next -poll pass, other changes are logged as needing a restart")
+
+// liveDebug and livePoll mirror -debug and -poll, which can be reloaded.
+var (
+	liveDebug int32
+	livePoll  int64
+)
+
+// hotSettings are the settings a reload applies, by flag name. The others
+// only take effect on restart.
+var hotSettings = map[string]func(value string) error{
+	"debug": func(value string) error {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		setLiveDebug(on)
+		return nil
+	},
+	"poll": func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d <= 0 || atomic.LoadInt64(&livePoll) <= 0 {
+			return errors.New("switching between polling and a single run needs a restart")
+		}
+		atomic.StoreInt64(&livePoll, int64(d))
+		return nil
+	},
+	"download-workers": func(value string) error { return resizeSlots(workSlots.download, value) },
+	"extract-workers":  func(value string) error { return resizeSlots(workSlots.extract, value) },
+}
+
+// config is what was last read from -config, and which flags were set on
+// the command line and so are not taken from it.
+var config struct {
+	mu          sync.Mutex
+	values      map[string]string
+	commandLine map[string]bool
+}
+
+// loadConfig sets the flags not given on the command line from -config.
+// It must run right after flag.Parse.
+func loadConfig() error {
+	config.commandLine = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { config.commandLine[f.Name] = true })
+	if *configFile != "" {
+		values, err := readConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			if config.commandLine[name] {
+				continue
+			}
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %s in config file: %v", name, err)
+			}
+		}
+		config.values = values
+	}
+	setLiveDebug(*debug)
+	atomic.StoreInt64(&livePoll, int64(*pollInterval))
+	return nil
+}
+
+// readConfig returns the settings in the config file at path. Errors do
+// not quote values, which may be secrets.
+func readConfig(path string) (map[string]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	defer fd.Close()
+	values := map[string]string{}
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d of config file is not name = value", n)
+		}
+		name := strings.TrimLeft(strings.TrimSpace(line[:i]), "-")
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("unknown setting %q on line %d of config file", name, n)
+		}
+		values[name] = strings.TrimSpace(line[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read config file: %v", err)
+	}
+	return values, nil
+}
+
+// reloadConfig reads -config again and applies what changed since it was
+// last read, logging what was applied and what needs a restart. Only the
+// values of hot settings are logged.
+func reloadConfig() {
+	if *configFile == "" {
+		log.Println("Got SIGHUP but there is no -config to reload")
+		return
+	}
+	values, err := readConfig(*configFile)
+	if err != nil {
+		log.Printf("Cannot reload config, keeping the current one: %v", err)
+		return
+	}
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	var changed []string
+	for name := range values {
+		if old, ok := config.values[name]; !ok || old != values[name] {
+			changed = append(changed, name)
+		}
+	}
+	for name := range config.values {
+		if _, ok := values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 {
+		log.Println("Reloaded config, nothing changed")
+		return
+	}
+	sort.Strings(changed)
+	kept := map[string]bool{}
+	for _, name := range changed {
+		value, ok := values[name]
+		if !ok {
+			value = flag.Lookup(name).DefValue
+		}
+		apply, hot := hotSettings[name]
+		switch {
+		case config.commandLine[name]:
+			log.Printf("Config sets %s, which is kept as given on the command line", name)
+		case !hot:
+			log.Printf("Config changes %s, restart to apply it", name)
+			kept[name] = true
+		default:
+			if err := apply(value); err != nil {
+				log.Printf("Cannot apply %s = %s from config: %v", name, value, err)
+				kept[name] = true
+				continue
+			}
+			log.Printf("Applied %s = %s from config", name, value)
+		}
+	}
+	for name := range kept {
+		// report them again on the next reload until they are applied.
+		if old, ok := config.values[name]; ok {
+			values[name] = old
+		} else {
+			delete(values, name)
+		}
+	}
+	config.values = values
+}
+
+// setLiveDebug turns the debug messages on or off.
+func setLiveDebug(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&liveDebug, v)
+}
+
+// resizeSlots sets how many slots the stage s has to value. The slots
+// apply at once, but the crawl only starts or retires workers to match
+// them from its next pass.
+func resizeSlots(s *slotLimit, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return errors.New("must be at least 1")
+	}
+	if s == nil {
+		return errors.New("no stage slots were set up")
+	}
+	before := workerCount()
+	s.resize(n)
+	atomic.StoreInt32(&stagedWorkers, 1)
+	if after := workerCount(); after != before {
+		log.Printf("The crawl runs %d workers from its next -poll pass, %d until then", after, before)
+	}
+	return nil
+}
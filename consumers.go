@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	consumerCheckOff  = "off"
+	consumerCheckWarn = "warn"
+	consumerCheckFail = "fail"
+)
+
+var (
+	consumerCheck     = flag.String("consumer-check", consumerCheckOff, "before crawling, sample the output queues twice and, if one holds at least -consumer-check-min xmls and is not shrinking, off: do nothing, warn: log it, fail: refuse to run")
+	consumerCheckMin  = flag.Int64("consumer-check-min", 10000, "output queue length under which -consumer-check does not bother")
+	consumerCheckWait = flag.Duration("consumer-check-wait", 10*time.Second, "time between the two samples of -consumer-check")
+)
+
+// checkConsumerPolicy returns an error if -consumer-check is not a known
+// policy or cannot be applied to the selected sink.
+func checkConsumerPolicy() error {
+	switch *consumerCheck {
+	case consumerCheckOff:
+		return nil
+	case consumerCheckWarn, consumerCheckFail:
+	default:
+		return fmt.Errorf("unknown consumer check %q", *consumerCheck)
+	}
+	if _, ok := output.(backlogger); !ok {
+		return fmt.Errorf("-consumer-check is not supported by sink %q", *sinkType)
+	}
+	return nil
+}
+
+// checkConsumers guesses whether the output queues of feeds have someone
+// consuming them: a long queue that does not shrink between two samples
+// likely has not. It is a heuristic, a busy consumer on a queue being fed
+// by another producer looks the same.
+func checkConsumers(pool *redis.Pool, feeds []*Feed) error {
+	if *consumerCheck == consumerCheckOff {
+		return nil
+	}
+	c := pool.Get()
+	defer c.Close()
+	b := output.(backlogger)
+	sample := func() ([]int64, error) {
+		lens := make([]int64, len(feeds))
+		for i, f := range feeds {
+			n, err := b.Backlog(c, f)
+			if err != nil {
+				return nil, &StoreError{Op: "cannot read output queue length", Err: err}
+			}
+			lens[i] = n
+		}
+		return lens, nil
+	}
+	before, err := sample()
+	if err != nil {
+		return err
+	}
+	stale := false
+	for _, n := range before {
+		stale = stale || n >= *consumerCheckMin
+	}
+	if !stale {
+		return nil
+	}
+	log.Printf("Checking the output queues are consumed, this takes %v", *consumerCheckWait)
+	time.Sleep(*consumerCheckWait)
+	after, err := sample()
+	if err != nil {
+		return err
+	}
+	for i, f := range feeds {
+		if before[i] < *consumerCheckMin || after[i] < before[i] {
+			continue
+		}
+		err := fmt.Errorf("output queue of feed %s holds %d xmls and did not shrink in %v, its consumer may be down", f.URL, after[i], *consumerCheckWait)
+		if *consumerCheck == consumerCheckFail {
+			return err
+		}
+		log.Print(err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	linkTimeout    = flag.Duration("link-timeout", 0, "time a zip download may take, retries included, when its size is not known; with -link-throughput also the base of the deadline of zips of known size. 0 for no limit")
+	linkThroughput = flag.Int64("link-throughput", 0, "bytes per second zip downloads are assumed to reach at least; zips whose Content-Length is known get -link-timeout plus their size over it to download, within -link-timeout-min and -link-timeout-max. 0 gives every zip -link-timeout")
+	linkTimeoutMin = flag.Duration("link-timeout-min", 0, "shortest deadline derived from the size of a zip, 0 for no bound")
+	linkTimeoutMax = flag.Duration("link-timeout-max", 0, "longest deadline derived from the size of a zip, 0 for no bound")
+)
+
+// errLinkDeadline is wrapped by the errors of downloads cut at their
+// deadline, they are not retried.
+var errLinkDeadline = errors.New("download deadline exceeded")
+
+// checkLinkTimeouts returns an error if the deadline flags are invalid.
+func checkLinkTimeouts() error {
+	if *linkTimeout < 0 || *linkThroughput < 0 || *linkTimeoutMin < 0 || *linkTimeoutMax < 0 {
+		return errors.New("-link-timeout, -link-throughput, -link-timeout-min and -link-timeout-max cannot be negative")
+	}
+	if *linkTimeoutMax > 0 && *linkTimeoutMin > *linkTimeoutMax {
+		return errors.New("-link-timeout-min cannot be above -link-timeout-max")
+	}
+	return nil
+}
+
+// linkDeadline cancels its context once the download of a zip takes
+// longer than allowed, which is only known for sure once its size is. A
+// timer moved along is used instead of a context deadline, which cannot be
+// extended once the size is known.
+type linkDeadline struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	start  time.Time
+	timer  *time.Timer
+	limit  time.Duration
+	// passed is set once the timer fired.
+	passed int32
+}
+
+// newLinkDeadline starts the deadline of a download made for ctx,
+// -link-timeout until its size is known. The download is also cut once
+// ctx is done.
+func newLinkDeadline(ctx context.Context) *linkDeadline {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &linkDeadline{ctx: ctx, cancel: cancel, start: time.Now()}
+	if *linkTimeout > 0 {
+		d.set(*linkTimeout)
+	}
+	return d
+}
+
+// set moves the deadline to limit after the start of the download.
+func (d *linkDeadline) set(limit time.Duration) {
+	d.limit = limit
+	wait := limit - time.Since(d.start)
+	if d.timer == nil {
+		d.timer = time.AfterFunc(wait, func() {
+			atomic.StoreInt32(&d.passed, 1)
+			d.cancel()
+		})
+		return
+	}
+	d.timer.Reset(wait)
+}
+
+// sized scales the deadline to a download of size bytes with
+// -link-throughput, leaving it unset if that comes to no time at all.
+func (d *linkDeadline) sized(size int64) {
+	if *linkThroughput <= 0 {
+		return
+	}
+	limit := *linkTimeout + time.Duration(float64(size)/float64(*linkThroughput)*float64(time.Second))
+	if limit < *linkTimeoutMin {
+		limit = *linkTimeoutMin
+	}
+	if *linkTimeoutMax > 0 && limit > *linkTimeoutMax {
+		limit = *linkTimeoutMax
+	}
+	if limit <= 0 {
+		return
+	}
+	debugf("Allowing %v to download %d bytes", limit, size)
+	d.set(limit)
+}
+
+// expired reports whether the deadline passed, rather than the download
+// being cancelled.
+func (d *linkDeadline) expired() bool {
+	return atomic.LoadInt32(&d.passed) == 1
+}
+
+// stop releases the deadline once the download is over.
+func (d *linkDeadline) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel()
+}
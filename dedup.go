@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+const (
+	dedupLink      = "link"
+	dedupLinkMtime = "link-mtime"
+)
+
+var dedupStrategy = flag.String("dedup", dedupLink, "what identifies an already processed zip: link, or link-mtime to combine the link with its ETag or Last-Modified header so updated zips under the same url are processed again")
+
+// checkDedupStrategy returns an error if -dedup is not a known strategy.
+func checkDedupStrategy() error {
+	switch *dedupStrategy {
+	case dedupLink, dedupLinkMtime:
+		return nil
+	}
+	return fmt.Errorf("unknown dedup strategy %q", *dedupStrategy)
+}
+
+// dedupKey returns the key the zip at link of feed f is recorded under
+// once processed. With the link-mtime strategy it asks the server for the
+// zip version, or looks at the file with -local-dir, and falls back to the
+// bare link only when the server sends no version or does not answer HEAD
+// requests. Failing to ask is an error, so a zip is never recorded under a
+// key other than that of its last run because of a passing failure.
+func dedupKey(f *Feed, link string) (string, error) {
+	if *dedupStrategy != dedupLinkMtime {
+		return link, nil
+	}
+	if *localDir != "" {
+		info, err := os.Stat(localArchive(link))
+		if err != nil {
+			return "", &DownloadError{Link: link, Op: "cannot get zip version", Err: err}
+		}
+		return link + "@" + info.ModTime().UTC().Format(http.TimeFormat), nil
+	}
+	zipURL := archiveURL(f, link)
+	if u, err := url.Parse(zipURL); err != nil || checkHost(u.Hostname()) != nil {
+		// never asked, fetchZip refuses it the same way.
+		return link, nil
+	}
+	response, err := zipClient.Head(zipURL)
+	if err != nil {
+		return "", &DownloadError{Link: link, Op: "cannot get zip version", Err: err}
+	}
+	closeBody(response.Body)
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return link, nil
+	default:
+		return "", &DownloadError{Link: link, Op: "cannot get zip version", Err: &StatusError{Code: response.StatusCode, Status: response.Status}}
+	}
+	version := response.Header.Get("ETag")
+	if version == "" {
+		version = response.Header.Get("Last-Modified")
+	}
+	if version == "" {
+		return link, nil
+	}
+	return link + "@" + version, nil
+}
+
+// dedupKey returns the key l is recorded under once processed, asking
+// dedupKey only the first time.
+func (l *Link) dedupKey() (string, error) {
+	if l.Key == "" {
+		key, err := dedupKey(l.Feed, l.URL)
+		if err != nil {
+			return "", err
+		}
+		l.Key = key
+	}
+	return l.Key, nil
+}
+
+type archiveKeyKey struct{}
+
+// withArchiveKey returns ctx carrying the key the archive being processed
+// in it is recorded under once processed, its xmls are recorded under it
+// too so a new version of the archive has its xmls pushed again.
+func withArchiveKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, archiveKeyKey{}, key)
+}
+
+// archiveKeyOf returns the key carried by ctx, zipName if none.
+func archiveKeyOf(ctx context.Context, zipName string) string {
+	if key, ok := ctx.Value(archiveKeyKey{}).(string); ok {
+		return key
+	}
+	return zipName
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxDrain bounds how much of an unread response body is discarded so its
+// connection can be reused, past it closing the connection is cheaper.
+const maxDrain = 64 << 10
+
+// closeBody discards what is left of body and closes it, so the client
+// can keep the connection alive for the next request. Every response body
+// is closed through it: bodies read to the end, as listings and manifests,
+// have at most trailing bytes left, while those given up on half way keep
+// their connection only if less than maxDrain is left.
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	if err := body.Close(); err != nil {
+		debugf("Cannot close response body: %v", err)
+	}
+}
+
+// retryBackoff is the wait before the first retry of a download, it
+// doubles with every further attempt.
+const retryBackoff = time.Second
+
+// fetchListing gets the feed page at pageURL, retrying with backoff up to
+// -listing-retries times when the server cannot be reached or answers
+// with a transient error, until ctx is done. The caller must close the
+// response body.
+func fetchListing(ctx context.Context, pageURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		log.Printf("Fetching listing %s, attempt %d", pageURL, attempt+1)
+		response, err := listingClient.Do(req)
+		retry := true
+		if err == nil {
+			if response.StatusCode == http.StatusOK {
+				return response, nil
+			}
+			err = &StatusError{Code: response.StatusCode, Status: response.Status}
+			retry = retryableStatus(response.StatusCode)
+			closeBody(response.Body)
+		}
+		if !retry || ctx.Err() != nil || attempt >= *listingRetries {
+			return nil, err
+		}
+		if !runRetries.take() {
+			return nil, outOfRetries(err)
+		}
+		wait := backoff(*listingBackoff, attempt)
+		log.Printf("Cannot fetch listing %s, retrying in %v: %v", pageURL, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// transfer is what is known of a zip download across its attempts.
+type transfer struct {
+	// written is how many bytes of the zip the local copy holds.
+	written int64
+	// resumable tells whether the server was seen to accept range
+	// requests, it holds across attempts that fail before learning it.
+	resumable bool
+	// validator is the strong ETag, or Last-Modified, of the zip, sent
+	// with If-Range so a zip that changed is downloaded again instead of
+	// resumed.
+	validator string
+}
+
+// downloadTo writes the contents of zipURL into f, when the transfer breaks
+// half way it is resumed with a range request if the server supports them
+// or restarted otherwise, up to -download-retries times. Statuses are only
+// retried if -retry-statuses or -other-status say so. The whole of it is
+// bound by the deadline of the link, and given up once ctx is done.
+func downloadTo(ctx context.Context, f *spoolFile, zipURL string) error {
+	dl := newLinkDeadline(ctx)
+	defer dl.stop()
+	t := &transfer{}
+	for attempt := 0; ; attempt++ {
+		err := downloadFrom(dl, f, zipURL, t)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if dl.expired() {
+			return fmt.Errorf("%w after %v at byte %d", errLinkDeadline, dl.limit, t.written)
+		}
+		var hostErr *HostError
+		var statusErr *StatusError
+		var sizeErr *SizeError
+		if errors.As(err, &hostErr) || errors.As(err, &sizeErr) || attempt >= *downloadRetries {
+			return err
+		}
+		if errors.As(err, &statusErr) && !retryableStatus(statusErr.Code) {
+			return err
+		}
+		if !runRetries.take() {
+			return outOfRetries(err)
+		}
+		if !t.resumable && t.written > 0 {
+			if err := f.rewind(); err != nil {
+				return err
+			}
+			t.written = 0
+		}
+		wait := backoff(retryBackoff, attempt)
+		log.Printf("Download of %s failed at byte %d, retrying in %v: %v", zipURL, t.written, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-dl.ctx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w after %v at byte %d", errLinkDeadline, dl.limit, t.written)
+		}
+	}
+}
+
+// downloadFrom writes the contents of zipURL into f from the t.written
+// bytes it already holds on, until the deadline dl, updating t with what
+// the server tells about the zip.
+func downloadFrom(dl *linkDeadline, f *spoolFile, zipURL string, t *transfer) error {
+	req, err := http.NewRequestWithContext(withStepTrace(dl.ctx), "GET", zipURL, nil)
+	if err != nil {
+		return err
+	}
+	if t.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", t.written))
+		if t.validator != "" {
+			req.Header.Set("If-Range", t.validator)
+		}
+	}
+	response, err := zipClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(response.Body)
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+		return &StatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	if t.written > 0 && response.StatusCode != http.StatusPartialContent {
+		// the server ignored the range, or the zip changed, the whole zip
+		// is coming again.
+		log.Printf("Server cannot resume %s, downloading it again", zipURL)
+		if err := f.rewind(); err != nil {
+			return err
+		}
+		t.written = 0
+	}
+	if t.written == 0 {
+		if response.ContentLength >= 0 {
+			if err := checkArchiveSize(response.ContentLength); err != nil {
+				return err
+			}
+			dl.sized(response.ContentLength)
+		}
+		t.validator = responseValidator(response)
+	}
+	body, multi, err := responseArchive(response)
+	if err != nil {
+		return err
+	}
+	switch {
+	case multi, response.Header.Get("Accept-Ranges") == "none":
+		// a range of a multipart body is not a range of the archive in it.
+		t.resumable = false
+	case response.StatusCode == http.StatusPartialContent, response.Header.Get("Accept-Ranges") == "bytes":
+		t.resumable = true
+	}
+	started := time.Now()
+	n, err := io.Copy(f, body)
+	runStats.timed("transfer", time.Since(started))
+	t.written += n
+	return err
+}
+
+// responseValidator returns what If-Range can take to tell whether the zip
+// in response changed: its strong ETag or else its Last-Modified date, if
+// any.
+func responseValidator(response *http.Response) string {
+	if etag := response.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return response.Header.Get("Last-Modified")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dumpLines = "lines"
+	dumpJSON  = "json"
+)
+
+var (
+	dumpLinksPath   = flag.String("dump-links", "", "write the url of every zip listed to this file as it is found, for diffing the feed between runs; {run} is replaced by the run id, otherwise every run overwrites the file")
+	dumpLinksFormat = flag.String("dump-links-format", dumpLines, `format of -dump-links: lines, one url per line; or json, one {"link": "...", "url": "...", "feed": "...", "found": "..."} per line`)
+	dryRun          = flag.Bool("dry-run", false, "list the feeds without downloading any zip; with -dump-links this is pure discovery")
+)
+
+// dumpedLink is a line of -dump-links with -dump-links-format=json.
+type dumpedLink struct {
+	Link  string    `json:"link"`
+	URL   string    `json:"url"`
+	Feed  string    `json:"feed,omitempty"`
+	Found time.Time `json:"found"`
+}
+
+// linkDumper writes the links of the run to -dump-links, a nil one
+// writes nothing.
+type linkDumper struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	err  error
+}
+
+var linkDump *linkDumper
+
+// checkDumpLinksFormat returns an error if -dump-links-format is not a
+// known format.
+func checkDumpLinksFormat() error {
+	switch *dumpLinksFormat {
+	case dumpLines, dumpJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown -dump-links-format %q", *dumpLinksFormat)
+}
+
+// openLinkDump creates the -dump-links file of the run, if any.
+func openLinkDump() error {
+	linkDump = nil
+	if *dumpLinksPath == "" {
+		return nil
+	}
+	fd, err := os.Create(strings.ReplaceAll(*dumpLinksPath, "{run}", runID))
+	if err != nil {
+		return fmt.Errorf("cannot create links dump: %v", err)
+	}
+	linkDump = &linkDumper{file: fd, w: bufio.NewWriter(fd)}
+	return nil
+}
+
+// add writes link of feed f.
+func (d *linkDumper) add(f *Feed, link string) {
+	if d == nil {
+		return
+	}
+	line := archiveURL(f, link)
+	if *dumpLinksFormat == dumpJSON {
+		record := dumpedLink{Link: link, URL: line, Found: time.Now().UTC()}
+		if f != nil {
+			record.Feed = f.URL
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		line = string(data)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err == nil {
+		_, d.err = fmt.Fprintln(d.w, line)
+	}
+}
+
+// close flushes and closes the dump, returning the first error writing
+// it.
+func (d *linkDumper) close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.w.Flush(); err != nil && d.err == nil {
+		d.err = err
+	}
+	if err := d.file.Close(); err != nil && d.err == nil {
+		d.err = err
+	}
+	if d.err != nil {
+		return fmt.Errorf("cannot write links dump: %v", d.err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// entryCountsQueue records how many xmls every archive had, pushed and
+// skipped, by archive key.
+const entryCountsQueue = "archive_entry_counts"
+
+var recordEntryCounts = flag.Bool("record-entry-counts", false, "record in the archive_entry_counts hash how many xmls every processed archive had, pushed and skipped")
+
+// entryCounts is what an archive contributed, an archive whose pushed and
+// skipped do not add up to its entries was not fully processed.
+type entryCounts struct {
+	Entries int `json:"entries"`
+	Pushed  int `json:"pushed"`
+	Skipped int `json:"skipped"`
+}
+
+// saveEntryCounts records counts for the archive recorded under zipName,
+// if -record-entry-counts is set.
+func saveEntryCounts(ctx context.Context, c redis.Conn, zipName string, counts entryCounts) error {
+	if !*recordEntryCounts {
+		return nil
+	}
+	record, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Do("HSET", feedOf(ctx).key(entryCountsQueue), zipName, record); err != nil {
+		return &StoreError{Op: "cannot record archive entry counts", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var entryIndex = flag.Bool("entry-index", false, "also record processed xmls in a redis set per archive, read once when the archive is opened, and check xmls against it before asking the processed hash; xmls missing from the set, as those of runs without this flag, are looked up in the hash and added to the set when found there. The hash is still written, so dropping the flag goes back to it")
+
+type entryIndexKey struct{}
+
+// indexKey returns the key of the set indexing the processed xmls of the
+// archive recorded under zipName in feed f.
+func indexKey(f *Feed, zipName string) string {
+	return f.key(processedQueue + ":" + zipName)
+}
+
+// withEntryIndex returns ctx carrying the processed xmls index of the
+// archive recorded under zipName, loaded with -entry-index.
+func withEntryIndex(ctx context.Context, c redis.Conn, zipName string) (context.Context, error) {
+	if !*entryIndex {
+		return ctx, nil
+	}
+	members, err := redis.Strings(c.Do("SMEMBERS", indexKey(feedOf(ctx), zipName)))
+	if err != nil {
+		return ctx, &StoreError{Op: "cannot read processed xmls index", Err: err}
+	}
+	index := make(map[string]bool, len(members))
+	for _, m := range members {
+		index[m] = true
+	}
+	return context.WithValue(ctx, entryIndexKey{}, index), nil
+}
+
+// entryIndexOf returns the index carried by ctx, nil if none.
+func entryIndexOf(ctx context.Context) map[string]bool {
+	index, _ := ctx.Value(entryIndexKey{}).(map[string]bool)
+	return index
+}
+
+// indexEntry adds the xml recorded under key to the index of its archive.
+func indexEntry(c redis.Conn, f *Feed, zipName, key string) error {
+	if !*entryIndex {
+		return nil
+	}
+	if _, err := c.Do("SADD", indexKey(f, zipName), key); err != nil {
+		return &StoreError{Op: "cannot index processed xml", Err: err}
+	}
+	return nil
+}
+
+// unindexEntry removes the xml recorded under key from the index of its
+// archive, so it is pushed again.
+func unindexEntry(c redis.Conn, f *Feed, zipName, key string) error {
+	if !*entryIndex {
+		return nil
+	}
+	if _, err := c.Do("SREM", indexKey(f, zipName), key); err != nil {
+		return &StoreError{Op: "cannot unindex processed xml", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// entryLimitedQueue records the zips left unfinished by
+// -max-entries-per-archive, with the number of xmls pushed from them.
+const entryLimitedQueue = "entry-limited"
+
+var maxEntriesPerArchive = flag.Int("max-entries-per-archive", 0, "stop pushing xmls from an archive after this many in a run; the archive is recorded in the entry-limited hash and not marked as processed, so the next run goes on with its next xmls. 0 for no limit")
+
+// errEntryLimit is wrapped by the errors of archives cut short by
+// -max-entries-per-archive.
+var errEntryLimit = errors.New("too many xmls in archive")
+
+// checkEntryLimit returns an error once pushed xmls of the archive
+// recorded under zipName reach -max-entries-per-archive, it is called
+// before every further entry.
+func checkEntryLimit(zipName string, pushed int) error {
+	if *maxEntriesPerArchive <= 0 || pushed < *maxEntriesPerArchive {
+		return nil
+	}
+	return &ArchiveError{Zip: zipName, Op: fmt.Sprintf("stopped after %d xmls", pushed), Err: errEntryLimit}
+}
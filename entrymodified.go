@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var entryModifiedSince = flag.String("entry-modified-since", "", "only process xmls modified after this time, as RFC 3339 or as a duration before the start, e.g. 2016-08-17T00:00:00Z or 48h; for picking up just the xmls added to archives updated in place. Xmls without a valid modification time are processed")
+
+// entryCutoff is -entry-modified-since parsed, zero for none.
+var entryCutoff time.Time
+
+// parseEntryModifiedSince sets entryCutoff from -entry-modified-since.
+func parseEntryModifiedSince() error {
+	if *entryModifiedSince == "" {
+		return nil
+	}
+	if t, err := time.Parse(time.RFC3339, *entryModifiedSince); err == nil {
+		entryCutoff = t
+		return nil
+	}
+	d, err := time.ParseDuration(*entryModifiedSince)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("-entry-modified-since must be an RFC 3339 time or a positive duration, not %q", *entryModifiedSince)
+	}
+	entryCutoff = time.Now().Add(-d)
+	return nil
+}
+
+// modifiedBefore reports whether the named entry, last modified at
+// modified, is older than -entry-modified-since and so skipped. Zero
+// times and those before the MS-DOS epoch, which zips without times
+// store, are taken as unknown.
+func modifiedBefore(name string, modified time.Time) bool {
+	if entryCutoff.IsZero() {
+		return false
+	}
+	if modified.IsZero() || modified.Year() < 1980 {
+		debugf("Xml %s has no valid modification time, processing it", name)
+		return false
+	}
+	if !modified.Before(entryCutoff) {
+		return false
+	}
+	debugf("Skipping xml %s, modified at %v, before -entry-modified-since", name, modified)
+	atomic.AddInt64(&runStats.entriesSkipped, 1)
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+var (
+	normalizeEntryNames  = flag.Bool("normalize-entry-names", false, "record processed xmls under their normalized name: trimmed, lowercased and with forward slashes, so case and separator variants of one xml in a zip are pushed once")
+	normalizeOutputNames = flag.Bool("normalize-output-names", false, "push xmls under their normalized name too, as their entry name in stream metadata and object keys")
+)
+
+// normalizeEntryName returns name trimmed, lowercased, with forward slash
+// separators and without leading, repeated or dot path elements.
+func normalizeEntryName(name string) string {
+	name = strings.ReplaceAll(strings.TrimSpace(name), `\`, "/")
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return strings.ToLower(name)
+}
+
+// dedupName returns the name the entry called name is recorded under.
+func dedupName(name string) string {
+	if *normalizeEntryNames {
+		return normalizeEntryName(name)
+	}
+	return name
+}
+
+// outputName returns the name the entry called name is pushed under.
+func outputName(name string) string {
+	if *normalizeOutputNames {
+		return normalizeEntryName(name)
+	}
+	return name
+}
+
+// archiveNames tracks the entry names seen in an archive so entries
+// sharing a name, which zips and tarballs allow, are told apart instead
+// of all but the first being skipped as processed.
+type archiveNames struct {
+	zip  string
+	seen map[string]bool
+}
+
+func newArchiveNames(zipName string) *archiveNames {
+	return &archiveNames{zip: zipName, seen: map[string]bool{}}
+}
+
+// unique returns name for its first entry in the archive, and name with a
+// ~2, ~3... suffix before its extension for the next ones. Entries are
+// read in the same order every run, so each keeps its name across runs.
+func (a *archiveNames) unique(name string) string {
+	if !a.seen[name] {
+		a.seen[name] = true
+		return name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		renamed := fmt.Sprintf("%s~%d%s", base, n, ext)
+		if !a.seen[renamed] {
+			a.seen[renamed] = true
+			log.Printf("Zip %s has more than one xml named %s, processing this one as %s", a.zip, name, renamed)
+			return renamed
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var entrySpool = flag.Bool("entry-spool", false, "write every xml to a temp file as it is extracted and push it from there, streaming it to sinks that can take a stream and reading it back into a buffer of its exact size for the others; keeps large xmls from growing buffers in memory. Cannot be used with options that need xmls in memory")
+
+// streamer is implemented by sinks that can push an entry straight from
+// its spooled file, of the given size, without reading it into memory. r
+// may be rewound to retry.
+type streamer interface {
+	PushFrom(c redis.Conn, e Entry, r io.ReadSeeker, size int64) error
+}
+
+// checkEntrySpool returns an error if -entry-spool is combined with flags
+// that need the contents of xmls in memory.
+func checkEntrySpool() error {
+	if !*entrySpool {
+		return nil
+	}
+	switch {
+	case len(entryTransforms) > 0:
+		return errors.New("-entry-spool cannot be used with -transform or -strip-bom")
+	case len(typeQueues) > 0:
+		return errors.New("-entry-spool cannot be used with -type-queues")
+	case *routeElement != "":
+		return errors.New("-entry-spool cannot be used with -route-element")
+	case *shardBy == shardByContent && *shards > 1:
+		return errors.New("-entry-spool cannot be used with -shard-by=content")
+	case *entryPrefixBytes > 0:
+		return errors.New("-entry-spool cannot be used with -entry-prefix-bytes")
+	}
+	return nil
+}
+
+// pushSpooled writes the entry read from r to a temp file and pushes e
+// from there, once its output queue has room, the temp file is removed
+// once done. It returns e as pushed, holding its contents only if they had
+// to be read into memory.
+func pushSpooled(ctx context.Context, c redis.Conn, e Entry, r io.Reader) (Entry, error) {
+	tempFile, err := ioutil.TempFile("", "entry-*.xml")
+	if err != nil {
+		return e, &ArchiveError{Zip: e.Zip, Entry: e.Name, Op: "cannot create temp file for xml", Err: err}
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	started := time.Now()
+	size, err := io.Copy(tempFile, r)
+	runStats.timed("entry.read", time.Since(started))
+	if err != nil {
+		return e, &ArchiveError{Zip: e.Zip, Entry: e.Name, Op: "cannot spool xml in zip", Err: err}
+	}
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		return e, &ArchiveError{Zip: e.Zip, Entry: e.Name, Op: "cannot rewind spooled xml", Err: err}
+	}
+	if err := waitForQueue(ctx, c, e); err != nil {
+		return e, err
+	}
+	started = time.Now()
+	if s, ok := sinkOf(ctx).(streamer); ok {
+		err = s.PushFrom(c, e, tempFile, size)
+	} else {
+		e.Data = make([]byte, size)
+		if _, err := io.ReadFull(tempFile, e.Data); err != nil {
+			return e, &ArchiveError{Zip: e.Zip, Entry: e.Name, Op: "cannot read spooled xml", Err: err}
+		}
+		err = sinkOf(ctx).Push(c, e)
+	}
+	runStats.timed("push", time.Since(started))
+	if err != nil {
+		return e, &StoreError{Op: "cannot push xml", Err: err}
+	}
+	return e, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import "fmt"
+
+// DownloadError is returned when a listing or a zip cannot be fetched from
+// the feed.
+type DownloadError struct {
+	// Link is the url or link that was being downloaded.
+	Link string
+	// Op describes what was being attempted.
+	Op  string
+	Err error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// ArchiveError is returned when a downloaded zip or one of its entries
+// cannot be read.
+type ArchiveError struct {
+	// Zip is the link of the zip being processed.
+	Zip string
+	// Entry is the name of the entry being processed, if any.
+	Entry string
+	// Op describes what was being attempted.
+	Op  string
+	Err error
+}
+
+func (e *ArchiveError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// StoreError is returned when redis rejects or fails a command.
+type StoreError struct {
+	// Op describes what was being attempted.
+	Op  string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is returned when the server answers a request with a status
+// other than the expected one.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "status " + e.Status
+}
+
+// HostError is returned when a zip is hosted on, or redirected to, a host
+// that zips must not be downloaded from.
+type HostError struct {
+	Host   string
+	Reason string
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Host, e.Reason)
+}
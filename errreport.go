@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+)
+
+const (
+	errorPolicyFail    = "fail"
+	errorPolicyCollect = "collect"
+)
+
+var (
+	errorPolicy = flag.String("error-policy", errorPolicyFail, "what a zip that fails to process does: fail the run right away, or collect the error, go on with the other zips and report every failure at the end")
+	maxErrors   = flag.Int("max-errors", 100, "failures kept for the report with -error-policy=collect, further ones are only counted")
+)
+
+// checkErrorPolicy returns an error if -error-policy is not a known policy.
+func checkErrorPolicy() error {
+	switch *errorPolicy {
+	case errorPolicyFail, errorPolicyCollect:
+		return nil
+	}
+	return fmt.Errorf("unknown error policy %q", *errorPolicy)
+}
+
+// linkFailure is a zip that failed to process.
+type linkFailure struct {
+	link string
+	err  error
+}
+
+// errorCollector gathers the failures of a run under the collect policy.
+type errorCollector struct {
+	mu       sync.Mutex
+	failures []linkFailure
+	total    int
+}
+
+var runErrors = &errorCollector{}
+
+// reset forgets the failures of the last run.
+func (e *errorCollector) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures, e.total = nil, 0
+}
+
+// add records that link of feed f failed with err, keeping up to
+// -max-errors.
+func (e *errorCollector) add(f *Feed, link string, err error) {
+	log.Printf("Cannot process zip %s/%s, going on: %v", f.URL, link, err)
+	runStats.errorSeen(err)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.total++
+	if len(e.failures) < *maxErrors {
+		e.failures = append(e.failures, linkFailure{link: link, err: err})
+	}
+}
+
+// err returns an error summing up the failures, nil if there were none.
+func (e *errorCollector) err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.total == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d zips failed to process", e.total)
+}
+
+// report logs every kept failure.
+func (e *errorCollector) report() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.total == 0 {
+		return
+	}
+	log.Printf("%d zips failed to process:", e.total)
+	for _, f := range e.failures {
+		log.Printf("  %s: %v", f.link, f.err)
+	}
+	if e.total > len(e.failures) {
+		log.Printf("  and %d more", e.total-len(e.failures))
+	}
+}
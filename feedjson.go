@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+const (
+	feedTypeHTML    = "html"
+	feedTypeJSON    = "json"
+	feedTypeSitemap = "sitemap"
+)
+
+var feedType = flag.String("feed-type", feedTypeHTML, `format of the feed: html, a page linking to the zips; or json, pages of {"archives": [{"url": "..."}], "next": "<next page url>"}; or sitemap, a sitemap.xml or sitemap index; or manifest, a manifest.json of {"archives": [{"url": "...", "size": 123, "sha256": "..."}]} whose sizes and hashes downloads are verified against`)
+
+// listLinks feeds the links of the zips in feed f to links, in the format
+// of the feed, and closes links once done. With -local-dir, -links-from or
+// -only the feed is not read at all.
+func listLinks(ctx context.Context, f *Feed, links chan string, fail chan error) {
+	if *localDir != "" {
+		readLocalDir(ctx, links, fail)
+		return
+	}
+	if *linksFrom != "" {
+		readLinksFile(ctx, *linksFrom, links, fail)
+		return
+	}
+	if *onlyLink != "" {
+		emitLink(ctx, links, *onlyLink)
+		close(links)
+		return
+	}
+	switch f.Type {
+	case feedTypeJSON:
+		downloadJSONLinks(ctx, f.URL, f.cursor, links, fail)
+	case feedTypeSitemap:
+		downloadSitemapLinks(ctx, f.URL, links, fail)
+	case feedTypeManifest:
+		downloadManifestLinks(ctx, f.URL, f.manifest, links, fail)
+	default:
+		downloadLinksList(ctx, f.URL, links, fail)
+	}
+}
+
+// checkFeedType returns an error if -feed-type is not a known format.
+func checkFeedType() error {
+	if !knownFeedType(*feedType) {
+		return fmt.Errorf("unknown feed type %q", *feedType)
+	}
+	return nil
+}
+
+// knownFeedType reports whether t is a feed format listLinks can read.
+func knownFeedType(t string) bool {
+	switch t {
+	case feedTypeHTML, feedTypeJSON, feedTypeSitemap, feedTypeManifest:
+		return true
+	}
+	return false
+}
+
+// jsonArchive is an element of the archives list of a json feed page.
+type jsonArchive struct {
+	URL  string `json:"url"`
+	Date string `json:"date"`
+}
+
+// downloadJSONLinks reads the json feed starting at firstPage, following
+// the next page links until there are none, and feeds the archive urls to
+// links, which is closed once done. It resumes at the page cursor left
+// off at unless the feed shifted since.
+func downloadJSONLinks(ctx context.Context, firstPage string, cursor *pageCursor, links chan string, fail chan error) {
+	defer close(links)
+	pageURL, expect := firstPage, ""
+	if saved, ok := cursor.resume(); ok {
+		log.Printf("Resuming feed at page %s, where the last run left off", saved.Page)
+		pageURL, expect = saved.Page, saved.Fingerprint
+	}
+	seen := map[string]bool{}
+	for pageURL != "" {
+		if seen[pageURL] {
+			log.Printf("Feed page %s was already read, stopping", pageURL)
+			break
+		}
+		seen[pageURL] = true
+		pg := cursor.startPage(pageURL)
+		next, fingerprint, err := readJSONPage(ctx, pageURL, cursor, pg, links)
+		if err != nil {
+			if ctx.Err() == nil {
+				fail <- err
+			}
+			return
+		}
+		if expect != "" && fingerprint != expect {
+			// older pages may have zips the cursor never saw.
+			log.Printf("Feed page %s changed since the last run, listing the feed from its first page", pageURL)
+			cursor.restart()
+			pageURL, expect = firstPage, ""
+			seen = map[string]bool{}
+			continue
+		}
+		expect = ""
+		cursor.pageRead(pg, fingerprint, next == "")
+		pageURL = next
+	}
+}
+
+// readJSONPage feeds the archive urls in the json feed page at pageURL,
+// tracked by cursor as pg, to links and returns the url of the next page,
+// if any, and the fingerprint of the archives listed. Relative urls are
+// resolved against the page. The page is decoded as it streams so large
+// pages are not held in memory.
+func readJSONPage(ctx context.Context, pageURL string, cursor *pageCursor, pg *cursorPage, links chan string) (string, string, error) {
+	response, err := fetchListing(ctx, pageURL)
+	if err != nil {
+		return "", "", &DownloadError{Link: pageURL, Op: "cannot get feed page", Err: err}
+	}
+	defer closeBody(response.Body)
+
+	parseErr := func(err error) error {
+		return &DownloadError{Link: pageURL, Op: "cannot parse feed page", Err: err}
+	}
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", "", parseErr(err)
+	}
+	// resolve returns ref, which may be relative to the page, as an
+	// absolute url.
+	resolve := func(ref string) (string, error) {
+		u, err := url.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("invalid url %q: %v", ref, err)
+		}
+		return base.ResolveReference(u).String(), nil
+	}
+	listed := sha256.New()
+	fingerprint := func() string { return hex.EncodeToString(listed.Sum(nil)[:8]) }
+	dec := json.NewDecoder(response.Body)
+	if err := expectDelim(dec, '{'); err != nil {
+		return "", "", parseErr(err)
+	}
+	var next string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", "", parseErr(err)
+		}
+		switch tok {
+		case "archives":
+			if err := expectDelim(dec, '['); err != nil {
+				return "", "", parseErr(err)
+			}
+			for dec.More() {
+				var archive jsonArchive
+				if err := dec.Decode(&archive); err != nil {
+					return "", "", parseErr(err)
+				}
+				if !hasArchiveExt(archive.URL) {
+					continue
+				}
+				link, err := resolve(archive.URL)
+				if err != nil {
+					return "", "", parseErr(err)
+				}
+				fmt.Fprintln(listed, link)
+				cursor.add(pg, link)
+				if !emitLink(ctx, links, link) {
+					return "", "", ctx.Err()
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return "", "", parseErr(err)
+			}
+		case "next":
+			var n *string
+			if err := dec.Decode(&n); err != nil {
+				return "", "", parseErr(err)
+			}
+			if n != nil {
+				next = *n
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return "", "", parseErr(err)
+			}
+		}
+	}
+	if next == "" {
+		return "", fingerprint(), nil
+	}
+	next, err = resolve(next)
+	if err != nil {
+		return "", "", parseErr(err)
+	}
+	return next, fingerprint(), nil
+}
+
+// expectDelim reads the next token from dec and fails unless it is delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, found %v", delim, tok)
+	}
+	return nil
+}
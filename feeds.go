@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var feedsFile = flag.String("feeds-file", "", `json file listing the feeds to crawl at once, as [{"url": "...", "type": "html", "namespace": "...", "output_queue": "..."}]; each feed may override -namespace and -output-queue`)
+
+// Feed is a listing of archives and where what is extracted from them
+// goes.
+type Feed struct {
+	URL string `json:"url"`
+	// Type is the format of the listing, as in -feed-type.
+	Type string `json:"type"`
+	// Namespace prefixes the redis keys of the feed, -namespace when
+	// empty.
+	Namespace string `json:"namespace"`
+	// OutputQueue is the list or stream the xmls of the feed are pushed
+	// to, -output-queue or -stream-key when empty.
+	OutputQueue string `json:"output_queue"`
+
+	// cursor tracks the pages of paginated feeds while crawling.
+	cursor *pageCursor
+	// manifest holds what manifest feeds list while crawling.
+	manifest *feedManifest
+}
+
+// Link is the link to an archive found in a feed.
+type Link struct {
+	URL  string
+	Feed *Feed
+	// Key is what the archive is recorded under once processed, empty
+	// until dedupKey is asked for it.
+	Key string
+}
+
+// key returns the redis key name has in the namespace of the feed. A nil
+// feed uses -namespace.
+func (f *Feed) key(name string) string {
+	if f == nil || f.Namespace == "" {
+		return redisKey(name)
+	}
+	return f.Namespace + ":" + name
+}
+
+// queue returns the output queue of the feed, def if it has none of its
+// own.
+func (f *Feed) queue(def string) string {
+	if f == nil || f.OutputQueue == "" {
+		return def
+	}
+	return f.OutputQueue
+}
+
+// loadFeeds returns the feeds to crawl, those in -feeds-file or the one
+// given by -feed-type otherwise.
+func loadFeeds() ([]*Feed, error) {
+	if *feedsFile == "" {
+		return []*Feed{{URL: feed, Type: *feedType}}, nil
+	}
+	if *localDir != "" || *linksFrom != "" || *onlyLink != "" {
+		return nil, fmt.Errorf("-feeds-file cannot be used with -local-dir, -links-from or -only")
+	}
+	data, err := os.ReadFile(*feedsFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read feeds file: %v", err)
+	}
+	var feeds []*Feed
+	if err := json.Unmarshal(data, &feeds); err != nil {
+		return nil, fmt.Errorf("cannot parse feeds file: %v", err)
+	}
+	if len(feeds) == 0 {
+		return nil, fmt.Errorf("feeds file lists no feeds")
+	}
+	for i, f := range feeds {
+		if f.URL == "" {
+			return nil, fmt.Errorf("feed %d in feeds file has no url", i)
+		}
+		if f.Type == "" {
+			f.Type = feedTypeHTML
+		}
+		if !knownFeedType(f.Type) {
+			return nil, fmt.Errorf("unknown feed type %q for feed %s", f.Type, f.URL)
+		}
+	}
+	return feeds, nil
+}
+
+type feedKey struct{}
+
+// withFeed returns ctx carrying the feed the archive being processed in it
+// comes from.
+func withFeed(ctx context.Context, f *Feed) context.Context {
+	return context.WithValue(ctx, feedKey{}, f)
+}
+
+// feedOf returns the feed carried by ctx, nil if none.
+func feedOf(ctx context.Context) *Feed {
+	f, _ := ctx.Value(feedKey{}).(*Feed)
+	return f
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var heartbeatInterval = flag.Duration("heartbeat", 0, "every this long set heartbeat:<run id> to the unix time in redis, expiring after three intervals, so external monitoring can tell the process is alive; 0 disables it")
+
+// startHeartbeat keeps the heartbeat of the current run fresh until the
+// returned function is called, which removes it.
+func startHeartbeat(pool *redis.Pool) (stop func()) {
+	if *heartbeatInterval <= 0 {
+		return func() {}
+	}
+	beat := func() string {
+		key := redisKey("heartbeat:" + liveRunID.Load().(string))
+		c := pool.Get()
+		defer c.Close()
+		ttl := 3 * heartbeatInterval.Milliseconds()
+		if _, err := c.Do("SET", key, time.Now().Unix(), "PX", ttl); err != nil {
+			log.Printf("Cannot send heartbeat: %v", err)
+		}
+		return key
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(*heartbeatInterval)
+		defer ticker.Stop()
+		// the heartbeats of earlier -poll passes are left to expire.
+		key := beat()
+		for {
+			select {
+			case <-done:
+				c := pool.Get()
+				defer c.Close()
+				if _, err := c.Do("DEL", key); err != nil {
+					log.Printf("Cannot remove heartbeat: %v", err)
+				}
+				return
+			case <-ticker.C:
+				key = beat()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
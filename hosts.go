@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// stringsFlag is a flag.Value that can be repeated, collecting every value.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+var allowHosts, denyHosts stringsFlag
+
+var perHostConcurrency = flag.Int("per-host-concurrency", 0, "maximum zips downloaded at once from a single host, 0 for no limit other than the worker count")
+
+func init() {
+	flag.Var(&allowHosts, "allow-host", "only download zips from this host, can be repeated; when unset every host not denied is allowed")
+	flag.Var(&denyHosts, "deny-host", "never download zips from this host, can be repeated; takes precedence over -allow-host")
+}
+
+// zipClient is used to download zips, it refuses to follow redirects to
+// hosts that are not allowed.
+var zipClient = &http.Client{CheckRedirect: checkRedirect}
+
+// checkHost returns a *HostError if zips must not be downloaded from host.
+func checkHost(host string) error {
+	host = strings.ToLower(host)
+	for _, h := range denyHosts {
+		if strings.ToLower(h) == host {
+			return &HostError{Host: host, Reason: "host is denied"}
+		}
+	}
+	if len(allowHosts) == 0 {
+		return nil
+	}
+	for _, h := range allowHosts {
+		if strings.ToLower(h) == host {
+			return nil
+		}
+	}
+	return &HostError{Host: host, Reason: "host is not allowed"}
+}
+
+// checkRedirect applies the host lists to every redirect, otherwise
+// behaving like the default policy.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return checkHost(req.URL.Hostname())
+}
+
+// hostLimiter bounds how many downloads run at once against each host.
+type hostLimiter struct {
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+var hostSlots = &hostLimiter{sems: map[string]chan struct{}{}}
+
+// acquire blocks until a download from host can start and returns the
+// function that must be called once it is done.
+func (l *hostLimiter) acquire(host string) func() {
+	if *perHostConcurrency <= 0 {
+		return func() {}
+	}
+	host = strings.ToLower(host)
+	l.mu.Lock()
+	sem, ok := l.sems[host]
+	if !ok {
+		sem = make(chan struct{}, *perHostConcurrency)
+		l.sems[host] = sem
+	}
+	l.mu.Unlock()
+	sem <- struct{}{}
+	return func() { <-sem }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// exitIdle is the exit code when -max-idle-time runs out.
+const exitIdle = 3
+
+var maxIdleTime = flag.Duration("max-idle-time", 0, "stop, with exit code 3, once no new zip is taken up for this long, across -poll passes too; 0 never stops for being idle")
+
+// idleWatchdog cancels the crawl once no new zip was taken up for
+// -max-idle-time.
+type idleWatchdog struct {
+	last  int64
+	fired int32
+}
+
+var idleWatch = &idleWatchdog{last: time.Now().UnixNano()}
+
+// touch records that a new zip was taken up.
+func (w *idleWatchdog) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// expired reports whether the watchdog cancelled the crawl.
+func (w *idleWatchdog) expired() bool {
+	return atomic.LoadInt32(&w.fired) == 1
+}
+
+// watch calls cancel once -max-idle-time passes without a touch, or
+// returns once ctx is done.
+func (w *idleWatchdog) watch(ctx context.Context, cancel func()) {
+	w.touch()
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+		if idle >= *maxIdleTime {
+			log.Printf("No new zips for %v, stopping", idle.Round(time.Second))
+			atomic.StoreInt32(&w.fired, 1)
+			cancel()
+			return
+		}
+		t := time.NewTimer(*maxIdleTime - idle)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+var (
+	indexPattern   = flag.String("index-pattern", "", "regexp of the links of an html feed that are index pages to read for more links rather than archives, for feeds listing e.g. monthly pages that list the daily zips; links found on index pages are resolved against them")
+	archivePattern = flag.String("archive-pattern", "", "regexp of the links of an html feed that are archives, by default those with an archive extension")
+	indexDepth     = flag.Int("index-depth", 3, "levels of -index-pattern pages followed below the feed")
+)
+
+// indexFilter and archiveFilter are -index-pattern and -archive-pattern
+// compiled by compileIndexPatterns, nil when unset.
+var indexFilter, archiveFilter *regexp.Regexp
+
+// compileIndexPatterns compiles -index-pattern and -archive-pattern.
+func compileIndexPatterns() error {
+	if *indexDepth < 0 {
+		return fmt.Errorf("-index-depth cannot be negative")
+	}
+	var err error
+	if *indexPattern != "" {
+		if indexFilter, err = regexp.Compile(*indexPattern); err != nil {
+			return fmt.Errorf("invalid -index-pattern: %v", err)
+		}
+	}
+	if *archivePattern != "" {
+		if archiveFilter, err = regexp.Compile(*archivePattern); err != nil {
+			return fmt.Errorf("invalid -archive-pattern: %v", err)
+		}
+	}
+	return nil
+}
+
+// isArchiveLink reports whether link of an html listing is an archive.
+func isArchiveLink(link string) bool {
+	if archiveFilter != nil {
+		return archiveFilter.MatchString(link)
+	}
+	return hasArchiveExt(link)
+}
+
+// isIndexLink reports whether link, found depth levels below the feed, is
+// an index page to follow.
+func isIndexLink(link string, depth int) bool {
+	return indexFilter != nil && depth < *indexDepth && indexFilter.MatchString(link)
+}
+
+// resolveLink returns link, found on the page at pageURL, as an absolute
+// url.
+func resolveLink(pageURL, link string) (string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
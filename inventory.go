@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var inventoryMode = flag.Bool("inventory", false, "download every archive in the feed and report how many entries and bytes they hold, without pushing anything or touching redis")
+
+// inventoryTally adds up the entries of the archives seen by -inventory.
+type inventoryTally struct {
+	mu           sync.Mutex
+	archives     int
+	unrecognized int
+	entries      int
+	compressed   uint64
+	uncompressed uint64
+}
+
+// add records one archive with the given entry count and sizes.
+func (t *inventoryTally) add(entries int, compressed, uncompressed uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.archives++
+	t.entries += entries
+	t.compressed += compressed
+	t.uncompressed += uncompressed
+}
+
+// report prints the totals to w.
+func (t *inventoryTally) report(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(w, "archives:           %d\n", t.archives)
+	fmt.Fprintf(w, "unrecognized:       %d\n", t.unrecognized)
+	fmt.Fprintf(w, "entries:            %d\n", t.entries)
+	fmt.Fprintf(w, "compressed bytes:   %d\n", t.compressed)
+	fmt.Fprintf(w, "uncompressed bytes: %d\n", t.uncompressed)
+}
+
+// inventory downloads every archive listed in feed f and prints how many
+// entries matching -entry-pattern they hold and their sizes. Zips are only
+// read up to their directory.
+func inventory(f *Feed, cache *archiveCache) error {
+	tally := &inventoryTally{}
+	err := forEachArchive(f, cache, func(link, zipFile string) error {
+		return inventoryArchive(f, link, zipFile, tally)
+	})
+	if err != nil {
+		return err
+	}
+	tally.report(os.Stdout)
+	return nil
+}
+
+// forEachArchive downloads every archive listed in feed f and calls fn
+// with its link and local copy, which is discarded afterwards. Nothing is
+// read from or written to redis.
+func forEachArchive(f *Feed, cache *archiveCache, fn func(link, zipFile string) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	links := make(chan string, linkBuffer)
+	fail := make(chan error, zipConcurrency+1)
+	var wg sync.WaitGroup
+	for i := 0; i < zipConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range links {
+				if err := fetchArchive(ctx, f, link, cache, fn); err != nil {
+					fail <- err
+					return
+				}
+				runProgress.linkDone()
+			}
+		}()
+	}
+	go listLinks(ctx, f, links, fail)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case err := <-fail:
+		return err
+	case <-done:
+	}
+	select {
+	case err := <-fail:
+		return err
+	default:
+		return nil
+	}
+}
+
+// fetchArchive downloads the archive at link of feed f, until ctx is done,
+// and calls fn with it.
+func fetchArchive(ctx context.Context, f *Feed, link string, cache *archiveCache, fn func(link, zipFile string) error) error {
+	zipFile, err := fetchZip(ctx, f, link, link, cache)
+	var hostErr *HostError
+	if errors.As(err, &hostErr) {
+		log.Printf("Skipping zip %s/%s: %v", f.URL, link, hostErr)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer discardZip(f, link, zipFile, cache)
+	return fn(link, zipFile)
+}
+
+// inventoryArchive adds the entries of the archive at zipFile, downloaded
+// from link of feed f, to tally.
+func inventoryArchive(f *Feed, link, zipFile string, tally *inventoryTally) error {
+	format, err := detectFormat(zipFile)
+	if err != nil {
+		return &ArchiveError{Zip: link, Op: "cannot read archive format", Err: err}
+	}
+	switch format {
+	case formatZip:
+		r, closer, err := openZipFile(zipFile)
+		if err != nil {
+			return &ArchiveError{Zip: link, Op: fmt.Sprintf("cannot open zip file %q", zipFile), Err: err}
+		}
+		defer closer.Close()
+		var entries int
+		var compressed, uncompressed uint64
+		for _, f := range r.File {
+			if entryFilter != nil && !entryFilter.MatchString(f.Name) {
+				continue
+			}
+			entries++
+			compressed += f.CompressedSize64
+			uncompressed += f.UncompressedSize64
+		}
+		tally.add(entries, compressed, uncompressed)
+	case formatTarGz:
+		entries, uncompressed, err := tarGzInventory(zipFile)
+		if err != nil {
+			return &ArchiveError{Zip: link, Op: "cannot read tarball", Err: err}
+		}
+		var compressed uint64
+		if size, err := archiveFileSize(zipFile); err == nil {
+			compressed = uint64(size)
+		}
+		tally.add(entries, compressed, uncompressed)
+	default:
+		log.Printf("Skipping zip %s/%s: unrecognized format", f.URL, link)
+		tally.mu.Lock()
+		tally.unrecognized++
+		tally.mu.Unlock()
+	}
+	return nil
+}
+
+// tarGzInventory counts the regular files in the gzipped tarball at path
+// and adds up their sizes. Tarballs have no directory, so the whole of it
+// is decompressed, but contents are skipped over.
+func tarGzInventory(path string) (int, uint64, error) {
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer gz.Close()
+	var entries int
+	var size uint64
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if hdr.Typeflag != tar.TypeReg || (entryFilter != nil && !entryFilter.MatchString(hdr.Name)) {
+			continue
+		}
+		entries++
+		size += uint64(hdr.Size)
+	}
+}
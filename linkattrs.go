@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var linkAttrs stringsFlag
+
+func init() {
+	flag.Var(&linkAttrs, "link-attr", "tag:attribute holding zip links in html feeds, e.g. button:data-download-url; can be repeated, defaults to a:href")
+}
+
+// linkSources maps the tags scanned for links in html feeds to the
+// attributes holding them, set up from -link-attr by parseLinkAttrs.
+var linkSources = map[string][]string{"a": {hrefAttr}}
+
+// parseLinkAttrs sets linkSources up from -link-attr.
+func parseLinkAttrs() error {
+	if len(linkAttrs) == 0 {
+		return nil
+	}
+	sources := map[string][]string{}
+	for _, pair := range linkAttrs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid -link-attr %q, expected tag:attribute", pair)
+		}
+		tag, attr := strings.ToLower(parts[0]), strings.ToLower(parts[1])
+		sources[tag] = append(sources[tag], attr)
+	}
+	linkSources = sources
+	return nil
+}
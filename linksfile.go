@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	linksFrom = flag.String("links-from", "", "process only the zip urls in this file, one per line, instead of reading the feed; blank lines and lines starting with # are ignored")
+	onlyLink  = flag.String("only", "", "process only the zip at this url instead of reading the feed")
+)
+
+// readLinksFile feeds the urls listed in the file at path to links and
+// closes it once done. Lines that are not absolute http urls are skipped.
+func readLinksFile(ctx context.Context, path string, links chan string, fail chan error) {
+	defer close(links)
+	fd, err := os.Open(path)
+	if err != nil {
+		fail <- fmt.Errorf("cannot open links file: %v", err)
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		link := strings.TrimSpace(scanner.Text())
+		if link == "" || strings.HasPrefix(link, "#") {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Printf("Skipping line %d of %s: %q is not an http url", line, path, link)
+			continue
+		}
+		if !emitLink(ctx, links, link) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail <- fmt.Errorf("cannot read links file: %v", err)
+	}
+}
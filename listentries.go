@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var listEntriesMode = flag.Bool("list-entries", false, "download the archives, usually just one with -only or those in -local-dir, print the name, size and compression method of their entries and exit; nothing is pushed and redis is not touched")
+
+// listEntries prints the entries of every archive listed in feed f.
+func listEntries(f *Feed, cache *archiveCache) error {
+	var mu sync.Mutex
+	return forEachArchive(f, cache, func(link, zipFile string) error {
+		// archives are printed whole, one at a time.
+		mu.Lock()
+		defer mu.Unlock()
+		return printEntries(os.Stdout, f, link, zipFile)
+	})
+}
+
+// printEntries writes the entries of the archive at zipFile, downloaded
+// from link of feed f, to w.
+func printEntries(w io.Writer, f *Feed, link, zipFile string) error {
+	format, err := detectFormat(zipFile)
+	if err != nil {
+		return &ArchiveError{Zip: link, Op: "cannot read archive format", Err: err}
+	}
+	switch format {
+	case formatZip:
+		r, closer, err := openZipFile(zipFile)
+		if err != nil {
+			return &ArchiveError{Zip: link, Op: fmt.Sprintf("cannot open zip file %q", zipFile), Err: err}
+		}
+		defer closer.Close()
+		fmt.Fprintf(w, "%s:\n", link)
+		for _, f := range r.File {
+			method := "deflate"
+			switch f.Method {
+			case zip.Store:
+				method = "store"
+			case zip.Deflate:
+			default:
+				method = fmt.Sprintf("method %d", f.Method)
+			}
+			if f.Flags&zipFlagEncrypted != 0 {
+				method += ", encrypted"
+			}
+			fmt.Fprintf(w, "  %s\t%d\t%s\n", f.Name, f.UncompressedSize64, method)
+		}
+	case formatTarGz:
+		fd, err := openArchiveFile(zipFile)
+		if err != nil {
+			return &ArchiveError{Zip: link, Op: "cannot open tarball", Err: err}
+		}
+		defer fd.Close()
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			return &ArchiveError{Zip: link, Op: "cannot decompress tarball", Err: err}
+		}
+		defer gz.Close()
+		fmt.Fprintf(w, "%s:\n", link)
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return &ArchiveError{Zip: link, Op: "cannot read tarball", Err: err}
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				fmt.Fprintf(w, "  %s\t%d\ttar.gz\n", hdr.Name, hdr.Size)
+			}
+		}
+	default:
+		log.Printf("Skipping zip %s/%s: unrecognized format", f.URL, link)
+	}
+	return nil
+}
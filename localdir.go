@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+var localDir = flag.String("local-dir", "", "process the zips under this directory instead of downloading them from the feed; they are recorded by their path relative to it and never removed")
+
+// readLocalDir feeds the paths of the zips under -local-dir, relative to
+// it, to links and closes it once done.
+func readLocalDir(ctx context.Context, links chan string, fail chan error) {
+	defer close(links)
+	err := filepath.WalkDir(*localDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !hasArchiveExt(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(*localDir, path)
+		if err != nil {
+			return err
+		}
+		if !emitLink(ctx, links, filepath.ToSlash(rel)) {
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		fail <- fmt.Errorf("cannot read local dir: %v", err)
+	}
+}
+
+// localArchive returns the path of the zip recorded as link under
+// -local-dir.
+func localArchive(link string) string {
+	return filepath.Join(*localDir, filepath.FromSlash(link))
+}
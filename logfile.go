@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	logFile       = flag.String("log-file", "", "also write the log to this file, rotated by -log-max-size; every line carries its run id so a single run can be told apart")
+	logMaxSize    = flag.Int64("log-max-size", 100, "megabytes -log-file grows to before it is rotated to <file>.1, <file>.1 to <file>.2 and so on")
+	logMaxBackups = flag.Int("log-max-backups", 5, "rotated -log-file files kept, older ones are removed")
+	logStderr     = flag.Bool("log-stderr", true, "keep logging to stderr with -log-file")
+)
+
+// setupLogFile sends the log to -log-file too.
+func setupLogFile() error {
+	if *logFile == "" {
+		return nil
+	}
+	if *logMaxSize < 1 || *logMaxBackups < 0 {
+		return fmt.Errorf("-log-max-size must be at least 1 and -log-max-backups cannot be negative")
+	}
+	rf := &rotatingFile{path: *logFile, maxSize: *logMaxSize << 20, backups: *logMaxBackups}
+	if err := rf.open(); err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	if *logStderr {
+		log.SetOutput(io.MultiWriter(os.Stderr, rf))
+	} else {
+		log.SetOutput(rf)
+	}
+	return nil
+}
+
+// rotatingFile is a file that is moved aside once it grows past maxSize,
+// keeping the last backups of them.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// open opens the file for appending.
+func (r *rotatingFile) open() error {
+	fd, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	r.file, r.size = fd, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// keep writing to the current file rather than lose lines.
+			fmt.Fprintf(os.Stderr, "cannot rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one, moves the file to the first of them
+// and starts a new one. The current file is kept if any step fails.
+func (r *rotatingFile) rotate() error {
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	if r.backups > 0 {
+		os.Remove(backup(r.backups))
+		for i := r.backups - 1; i >= 1; i-- {
+			if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(r.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	old := r.file
+	if err := r.open(); err != nil {
+		r.file = old
+		return err
+	}
+	return old.Close()
+}
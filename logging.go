@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var debug = flag.Bool("debug", false, "log detailed per zip and per xml messages")
+
+// debugf logs like log.Printf only when -debug is set, or was reloaded
+// on.
+func debugf(format string, v ...interface{}) {
+	if atomic.LoadInt32(&liveDebug) != 0 {
+		log.Printf(format, v...)
+	}
+}
+
+const (
+	// skipLogEvery and skipLogInterval bound how often the running count
+	// of skipped zips is logged.
+	skipLogEvery    = 1000
+	skipLogInterval = 10 * time.Second
+)
+
+// skipCounter aggregates the "already processed" messages, which on a
+// mostly processed feed would otherwise be one line per link.
+type skipCounter struct {
+	mu       sync.Mutex
+	total    int
+	sinceLog int
+	lastLog  time.Time
+}
+
+var skippedZips = &skipCounter{}
+
+// reset zeroes the count for a new run.
+func (s *skipCounter) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total, s.sinceLog, s.lastLog = 0, 0, time.Time{}
+}
+
+// skip records that link of feed f was skipped for being already
+// processed.
+func (s *skipCounter) skip(f *Feed, link string) {
+	debugf("Zip %s/%s already processed", f.URL, link)
+	metrics.count("zips.skipped", 1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	s.sinceLog++
+	if s.sinceLog < skipLogEvery && time.Since(s.lastLog) < skipLogInterval {
+		return
+	}
+	log.Printf("Skipped %d already processed zips so far", s.total)
+	s.sinceLog = 0
+	s.lastLog = time.Now()
+}
+
+// count returns how many zips were skipped so far.
+func (s *skipCounter) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	loginPageSkip = "skip"
+	loginPageFail = "fail"
+)
+
+var loginPagePolicy = flag.String("login-page", loginPageSkip, "what to do with a zip that downloads as an html page, usually a login page after the session expired: skip it, to be retried next run, or fail the run")
+
+// errLoginPage is wrapped by the errors of downloads that turned out to be
+// html pages.
+var errLoginPage = errors.New("download is an html page, the session may have expired")
+
+// checkLoginPagePolicy returns an error if -login-page is not a known
+// policy.
+func checkLoginPagePolicy() error {
+	switch *loginPagePolicy {
+	case loginPageSkip, loginPageFail:
+		return nil
+	}
+	return fmt.Errorf("unknown login page policy %q", *loginPagePolicy)
+}
+
+// looksLikeHTML reports whether the file at path holds an html page.
+func looksLikeHTML(path string) bool {
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(fd, head)
+	head = head[:n]
+	if strings.HasPrefix(http.DetectContentType(head), "text/html") {
+		return true
+	}
+	lower := bytes.ToLower(head)
+	return bytes.Contains(lower, []byte("<html")) || bytes.Contains(lower, []byte("<!doctype html"))
+}
@@ -1,27 +1,38 @@
 package main
 
 import (
-	"archive/zip"
-	"bufio"
-	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"math/rand"
+	"net/url"
 	"os"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"golang.org/x/net/html"
 )
 
 const (
-	redisAddr       = "127.0.0.1:6379"
 	downloadedQueue = "zips"
 	processedQueue  = "xmls"
+	// unrecognizedQueue records links whose contents are not an archive
+	// format we can extract, they are not marked as downloaded.
+	unrecognizedQueue = "unrecognized"
+	// emptyQueue records links that downloaded as 0 bytes with
+	// -record-empty, they are not marked as downloaded either.
+	emptyQueue = "empty"
 )
 
 const (
@@ -29,16 +40,197 @@ const (
 	hrefAttr       = "href"
 	zipSuffix      = ".zip"
 	zipConcurrency = 3
+	// linkBuffer is how many links the parser can find ahead of the
+	// workers.
+	linkBuffer = 16
 )
 
+// workerStartJitter bounds the random delay each worker waits before
+// starting so they do not all hit the feed at the same instant.
+const workerStartJitter = 2 * time.Second
+
 var minProtocolLen = len("http://")
 
+// maxTempNameLen bounds how much of the zip name goes into its temp file
+// name.
+const maxTempNameLen = 64
+
+var (
+	cacheDir      = flag.String("cache-dir", "", "keep downloaded zips in this dir until fully processed so retries do not download them again")
+	cacheMaxBytes = flag.Int64("cache-max-bytes", 10<<30, "evict the oldest cached zips once the cache exceeds this many bytes, 0 for no limit")
+	cacheMaxAge   = flag.Duration("cache-max-age", 7*24*time.Hour, "evict cached zips older than this, 0 for no limit")
+
+	entryKeyFormat  = flag.String("entry-key", "{zip}/{entry}", "key processed xmls are recorded under, {zip} and {entry} are replaced by the zip link, with its version under -dedup=link-mtime, and the entry name")
+	legacyEntryKeys = flag.Bool("legacy-entry-keys", false, "record processed xmls by entry name only, as older versions did; same named entries of different zips collide")
+
+	force = flag.Bool("force", false, "download and push every zip and xml even if already processed, they are still recorded as processed")
+
+	listingRetries   = flag.Int("listing-retries", 5, "times fetching the feed listing is retried when the server is unreachable or answers 429 or 5xx")
+	listingBackoff   = flag.Duration("listing-backoff", 2*time.Second, "wait before the first listing retry, doubled on every further one")
+	listingMaxTokens = flag.Int("listing-max-tokens", 10000000, "give up on an html listing after this many tokens, so a broken page cannot keep the parser busy forever; 0 for no limit")
+	listingParseTime = flag.Duration("listing-parse-time", 30*time.Minute, "give up on an html listing after reading and parsing it for this long, waits on the workers aside; 0 for no limit")
+	downloadRetries  = flag.Int("download-retries", 3, "times a broken zip download is resumed, or restarted when the server does not support ranges")
+
+	verboseZip = flag.Bool("verbose-zip", false, "log entry count and compressed and uncompressed sizes of every zip")
+
+	outputQueue = flag.String("output-queue", "NEWS_XML", "redis list extracted xmls are pushed to")
+
+	recordEmpty = flag.Bool("record-empty", false, "record zips that download as 0 bytes in the empty hash, they are skipped and retried next run either way")
+
+	onlyNew             = flag.Bool("only-new", false, "stop listing a feed at its first zip already processed; only correct for feeds listing their newest zips first")
+	maxConsecutiveSkips = flag.Int("max-consecutive-skips", 0, "stop listing a feed after this many already processed zips in a row; a looser -only-new for feeds listing their newest zips mostly first. 0 for no limit")
+
+	keepFailed = flag.Bool("keep-failed", false, "keep the local copy of zips that fail to process and log where it is")
+
+	minExpected = flag.Int("min-expected", 0, "exit with an error if the run pushes fewer new xmls than this")
+
+	selftestMode = flag.Bool("selftest", false, "push a generated zip through download, extract and push against the configured redis, report whether it landed and exit")
+)
+
 func main() {
+	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupLogFile(); err != nil {
+		log.Fatal(err)
+	}
+	rand.Seed(time.Now().UnixNano())
+	if err := setupRunID(1); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDedupStrategy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkFeedType(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkArchiveURLTemplate(); err != nil {
+		log.Fatal(err)
+	}
+	feeds, err := loadFeeds()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := checkRetryBudgetPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseLinkAttrs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkErrorPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupTransforms(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkChecksumPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkShards(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkOutputList(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDumpLinksFormat(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkLinkTimeouts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseEntryModifiedSince(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkVerifyWrites(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkMode(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkStatusPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTypeQueues(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseArchiveExts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupStatsd(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSecrets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupTransport(feeds); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupWorkers(); err != nil {
+		log.Fatal(err)
+	}
+	if err := compileEntryPattern(); err != nil {
+		log.Fatal(err)
+	}
+	if err := compileIndexPatterns(); err != nil {
+		log.Fatal(err)
+	}
+	switch *sortEntries {
+	case "", sortByName, sortByModified:
+	default:
+		log.Fatalf("unknown entry order %q", *sortEntries)
+	}
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.Fatalf("cannot set up tracing: %v", err)
+	}
+	defer shutdownTracing()
+	if output, err = newSink(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkQueuePolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkSpoolCompress(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkEntrySpool(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkConsumerPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkLoginPagePolicy(); err != nil {
+		log.Fatal(err)
+	}
+	var cache *archiveCache
+	if *cacheDir != "" {
+		cache, err = newArchiveCache(*cacheDir, *cacheMaxBytes, *cacheMaxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *listEntriesMode {
+		for _, f := range feeds {
+			if err := listEntries(f, cache); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	if *inventoryMode {
+		for _, f := range feeds {
+			if err := inventory(f, cache); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
 	pool := &redis.Pool{
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisAddr)
+			return dialRedis()
 		},
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			if time.Since(t) < time.Minute {
@@ -48,152 +240,717 @@ func main() {
 			return err
 		},
 	}
-	links := make(chan string)
-	fail := make(chan error)
-	done := make(chan struct{})
-	for i := 0; i < zipConcurrency; i++ {
-		go processLinks(links, fail, pool)
+	if err := pingRedis(pool); err != nil {
+		log.Fatal(err)
 	}
-	go downloadLinksList(feed, links, fail, done)
-	select {
-	case err := <-fail:
+	if *statsMode {
+		c := pool.Get()
+		defer c.Close()
+		if err := printStats(c, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *replayFrom != "" {
+		if err := replay(pool); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *selftestMode {
+		if err := selftest(pool, cache); err != nil {
+			log.Fatalf("Selftest failed: %v", err)
+		}
+		log.Println("Selftest passed")
+		return
+	}
+	if err := checkConsumers(pool, feeds); err != nil {
 		log.Fatal(err)
-	case <-done:
+	}
+	handlePauseSignals()
+	handleReloadSignal()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *maxIdleTime > 0 {
+		go idleWatch.watch(ctx, cancel)
+	}
+	stopHeartbeat := startHeartbeat(pool)
+	if *pollInterval > 0 {
+		poll(ctx, feeds, pool, cache)
+		stopHeartbeat()
+		if idleWatch.expired() {
+			os.Exit(exitIdle)
+		}
 		return
 	}
+	result, err := runPass(ctx, feeds, pool, cache)
+	stopHeartbeat()
+	if idleWatch.expired() {
+		os.Exit(exitIdle)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if result.EntriesPushed < int64(*minExpected) {
+		log.Fatalf("Pushed %d new xmls, fewer than the %d expected by -min-expected", result.EntriesPushed, *minExpected)
+	}
 }
 
-// processZip opens a zipfile in the given path and logs its conents a
-// list in the given redis connection.
-func processZip(zipFile, zipName string, c redis.Conn) error {
-	log.Printf("Processing zip %s", zipName)
-	r, err := zip.OpenReader(zipFile)
-	if err != nil {
-		return fmt.Errorf("cannot open zip file %q %v", zipFile, err)
+// runPass crawls feeds once as a run of its own, recording it in the runs
+// hash and logging its counts.
+func runPass(ctx context.Context, feeds []*Feed, pool *redis.Pool, cache *archiveCache) (RunResult, error) {
+	c := pool.Get()
+	defer c.Close()
+	if err := startRun(c); err != nil {
+		return RunResult{}, err
+	}
+	err := crawl(ctx, feeds, pool, cache)
+	if err == nil {
+		err = runErrors.err()
+	}
+	if releaseErr := runClaims.release(c); releaseErr != nil {
+		log.Print(releaseErr)
 	}
-	defer r.Close()
+	result, recordErr := finishRun(c, err)
+	metrics.timing("run", result.Duration())
+	if recordErr != nil {
+		log.Print(recordErr)
+	}
+	runErrors.report()
+	result.log()
+	return result, err
+}
 
-	for _, f := range r.File {
-		log.Printf("Processing xml %s", f.Name)
-		reply, err := redis.String(c.Do("HGET", processedQueue, f.Name))
-		if err != nil && err != redis.ErrNil {
-			return fmt.Errorf("cannot check if xml exists: %v", err)
+// crawl feeds the links listed in feeds to workerCount workers shared
+// by all of them and waits until all links are processed or one fails.
+// Once one fails, or ctx is done, the parsers stop and the links not yet
+// processed are left alone. With -mode=discover the workers push the links
+// to the work queue instead, and with -mode=process the links come from it
+// rather than from the feeds.
+func crawl(ctx context.Context, feeds []*Feed, pool *redis.Pool, cache *archiveCache) (err error) {
+	if *runMode == modeProcess {
+		return processQueue(ctx, feeds, pool, cache)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if err := openLinkDump(); err != nil {
+		return err
+	}
+	defer func() {
+		if dumpErr := linkDump.close(); err == nil {
+			err = dumpErr
 		}
-		if len(reply) > 0 {
-			continue
+	}()
+	// the buffer lets the parsers run ahead of the workers instead of
+	// stalling on every link.
+	links := make(chan Link, linkBuffer)
+	// every worker, parser and dispatcher fails at most once.
+	workers := workerCount()
+	fail := make(chan error, workers+2*len(feeds))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if !rampWait(ctx, i, workers) {
+				return
+			}
+			if *runMode == modeDiscover {
+				queueLinks(ctx, links, fail, pool)
+			} else {
+				processLinks(ctx, links, fail, pool, cache)
+			}
+		}(i)
+	}
+	if *showProgress {
+		stop := make(chan struct{})
+		defer close(stop)
+		go runProgress.report(stop)
+	}
+	var listers sync.WaitGroup
+	// dropped counts the links parsed but never handed to the workers.
+	var dropped int64
+	for _, f := range feeds {
+		switch f.Type {
+		case feedTypeJSON:
+			f.cursor = newPageCursor(f, pool)
+		case feedTypeManifest:
+			f.manifest = newFeedManifest(f, pool)
 		}
-		fd, err := f.Open()
-		if err != nil {
-			return fmt.Errorf("cannot open xml on zip: %v", err)
+		feedLinks := make(chan string)
+		feedCtx, stopFeed := context.WithCancel(ctx)
+		go listLinks(feedCtx, f, feedLinks, fail)
+		listers.Add(1)
+		go func(f *Feed) {
+			defer listers.Done()
+			defer stopFeed()
+			if !dispatchLinks(ctx, f, feedLinks, links, fail, pool) {
+				atomic.AddInt64(&dropped, 1)
+			}
+		}(f)
+	}
+	listed := make(chan struct{})
+	go func() {
+		listers.Wait()
+		if ctx.Err() == nil {
+			runProgress.listingDone()
 		}
-		var buf bytes.Buffer
-		writer := bufio.NewWriter(&buf)
-		_, err = io.Copy(writer, fd)
-		if err != nil {
-			return fmt.Errorf("cannot read xml in xip: %v", err)
+		close(links)
+		close(listed)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case err = <-fail:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-done:
+		select {
+		case err = <-fail:
+		default:
+			return nil
 		}
-		writer.Flush()
-		fd.Close()
-		c.Do("LPUSH", "NEWS_XML", buf.String())
-		_, err = c.Do("HSET", processedQueue, f.Name, f.Name)
-		if err != nil {
-			return fmt.Errorf("cannot set processed Queue: %v", err)
+	}
+	runStats.errorSeen(err)
+	cancel()
+	<-listed
+	if n := atomic.LoadInt64(&dropped) + int64(len(links)); n > 0 {
+		log.Printf("Stopping, %d listed links were not processed", n)
+	}
+	return err
+}
+
+// dispatchLinks hands the links parsed from feed f over to the workers
+// until there are no more, or until the first already processed one with
+// -only-new, or the last of -max-consecutive-skips in a row. With
+// -snapshot the whole listing is read before the first link is handed
+// over. It returns false if ctx was done before a link could be handed
+// over.
+func dispatchLinks(ctx context.Context, f *Feed, feedLinks chan string, links chan Link, fail chan error, pool *redis.Pool) bool {
+	checkProcessed := *onlyNew || *maxConsecutiveSkips > 0
+	var c redis.Conn
+	if checkProcessed {
+		c = pool.Get()
+		defer c.Close()
+	}
+	if *snapshot {
+		feedLinks = snapshotLinks(ctx, f, feedLinks)
+		if ctx.Err() != nil {
+			return false
 		}
 	}
-	return nil
+	skips := 0
+	for link := range feedLinks {
+		l := Link{URL: link, Feed: f}
+		if checkProcessed {
+			processed := false
+			key, err := l.dedupKey()
+			if err != nil {
+				// processLink asks again and deals with the failure.
+				debugf("Cannot get version of zip %s/%s, handing it over: %v", f.URL, link, err)
+			} else if processed, err = hashHas(c, f.key(downloadedQueue), key); err != nil {
+				fail <- &StoreError{Op: "cannot check download queue", Err: err}
+				return true
+			}
+			if processed && *onlyNew {
+				log.Printf("Zip %s/%s was already processed, not listing further zips of the feed", f.URL, link)
+				return true
+			}
+			if !processed {
+				skips = 0
+			} else {
+				skips++
+				if *maxConsecutiveSkips > 0 && skips >= *maxConsecutiveSkips {
+					log.Printf("%d zips in a row up to %s/%s were already processed, not listing further zips of the feed", skips, f.URL, link)
+					return true
+				}
+			}
+		}
+		linkDump.add(f, link)
+		if *dryRun {
+			continue
+		}
+		select {
+		case links <- l:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
 }
 
 // processLinks obtains links from the given channel and downloads their
 // contents for posterior process, sending any failure through the fail
 // channel.
-func processLinks(links chan string, fail chan error, pool *redis.Pool) {
+func processLinks(ctx context.Context, links chan Link, fail chan error, pool *redis.Pool, cache *archiveCache) {
+	time.Sleep(jitter(workerStartJitter))
 	c := pool.Get()
 	defer c.Close()
-	for {
-		link := <-links
-
-		reply, err := redis.String(c.Do("HGET", downloadedQueue, link))
-		if err != nil && err != redis.ErrNil {
-			fail <- fmt.Errorf("cannot check download queue: %v", err)
+	for link := range links {
+		workPause.wait(ctx)
+		if ctx.Err() != nil {
+			return
 		}
-		if len(reply) > 0 {
-			log.Printf("Zip %s/%s already processed", feed, link)
-			continue
+		settled, err := processLink(ctx, link, c, cache)
+		if err != nil {
+			atomic.AddInt64(&runStats.failed, 1)
+			if *errorPolicy == errorPolicyCollect {
+				runErrors.add(link.Feed, link.URL, err)
+				runProgress.linkDone()
+				continue
+			}
+			fail <- err
+			return
 		}
+		runProgress.linkDone()
+		if settled {
+			link.done()
+		}
+	}
+}
+
+// emitLink hands link over to the workers, waiting first if the crawl is
+// paused. It returns false if ctx is done before the workers take it, the
+// caller must then stop listing.
+func emitLink(ctx context.Context, links chan string, link string) bool {
+	workPause.wait(ctx)
+	if ctx.Err() != nil {
+		return false
+	}
+	runProgress.linkFound()
+	select {
+	case links <- link:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// processLink downloads the zip at l and pushes its xmls into redis, in
+// the namespace of its feed, unless it was already processed. Once ctx is
+// done it stops waiting on a full output queue. It reports whether the zip
+// is settled: recorded as downloaded, found so or found gone. Any other
+// zip, failed or left for a later run, must be listed again.
+func processLink(ctx context.Context, l Link, c redis.Conn, cache *archiveCache) (settled bool, err error) {
+	link, f := l.URL, l.Feed
+	ctx, span := tracer.Start(withFeed(ctx, f), "download", trace.WithAttributes(attribute.String("link", link)))
+	defer func() { endSpan(span, err) }()
+
+	claimed, err := runClaims.claim(c, f, link)
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		debugf("Zip %s/%s was listed more than once, skipping the repeat", f.URL, link)
+		return false, nil
+	}
 
-		tempFile, err := ioutil.TempFile("", "zip")
+	key, err := l.dedupKey()
+	if err != nil {
+		return false, skipForError(c, f, link, err)
+	}
+	if !*force {
+		downloaded, err := hashHas(c, f.key(downloadedQueue), key)
 		if err != nil {
-			fail <- fmt.Errorf("cannot open tempfile to write zip: %v", err)
+			return false, &StoreError{Op: "cannot check download queue", Err: err}
 		}
-		defer os.Remove(tempFile.Name())
+		if downloaded {
+			recheck, err := needsRecheck(c, f, key)
+			if err != nil {
+				return false, err
+			}
+			if !recheck {
+				skippedZips.skip(f, link)
+				return true, nil
+			}
+			log.Printf("Rechecking zip %s/%s, downloaded within -recheck-since", f.URL, link)
+		}
+		gone, err := hashHas(c, f.key(goneQueue), link)
+		if err != nil {
+			return false, &StoreError{Op: "cannot check gone zips", Err: err}
+		}
+		if gone {
+			debugf("Zip %s/%s is gone, skipping it", f.URL, link)
+			return true, nil
+		}
+	}
 
-		log.Printf("Downloading zip %s/%s", feed, link)
-		response, err := http.Get(feed + "/" + link)
-		defer response.Body.Close()
+	idleWatch.touch()
 
-		// lets get the contents into a file, we dont know the size
-		// and therefore are not sure if we can hold many of these
-		// in memory.
-		_, err = io.Copy(tempFile, response.Body)
-		if err != nil {
-			fail <- fmt.Errorf("cannot copy response body from zip file into temp file: %v", err)
+	release := acquire(workSlots.download)
+	zipFile, err := fetchZip(ctx, f, link, key, cache)
+	release()
+	if err != nil {
+		return false, skipForError(c, f, link, err)
+	}
+	if size, err := archiveFileSize(zipFile); err == nil {
+		span.SetAttributes(attribute.Int64("zip.bytes", size))
+		if size == 0 {
+			log.Printf("Skipping zip %s/%s: empty download, it will be retried next run", f.URL, link)
+			discardZip(f, key, zipFile, cache)
+			if *recordEmpty {
+				if _, err := c.Do("HSET", f.key(emptyQueue), link, time.Now().Unix()); err != nil {
+					return false, &StoreError{Op: "cannot record empty zip", Err: err}
+				}
+			}
+			return false, nil
+		}
+		if err := checkArchiveSize(size); err != nil {
+			discardZip(f, key, zipFile, cache)
+			return false, skipForSize(c, f, link, err.(*SizeError))
 		}
+	}
+	if a, listed := f.manifest.lookup(link); listed || *verifyChecksums {
+		var ok bool
+		if listed {
+			ok, err = verifyManifest(a, zipFile)
+		} else {
+			ok, err = verifyChecksum(f, link, zipFile)
+		}
+		switch {
+		case errors.Is(err, errNoChecksum) && *missingChecksum == missingChecksumProcess:
+			log.Printf("Zip %s/%s has no checksum, processing it unverified", f.URL, link)
+		case err != nil:
+			discardFailedZip(f, link, key, zipFile, cache)
+			return false, &DownloadError{Link: link, Op: "cannot verify zip checksum", Err: err}
+		case !ok:
+			log.Printf("Skipping zip %s/%s: it does not match its checksum", f.URL, link)
+			// a cached copy must be downloaded again next time.
+			if cache != nil && !*keepFailed {
+				cache.remove(f.key(key))
+			}
+			discardFailedZip(f, link, key, zipFile, cache)
+			if _, err := c.Do("HSET", f.key(corruptQueue), link, time.Now().Unix()); err != nil {
+				return false, &StoreError{Op: "cannot record corrupt zip", Err: err}
+			}
+			return false, nil
+		}
+	}
 
-		if err := processZip(tempFile.Name(), link, c); err != nil {
-			fail <- fmt.Errorf("while processing zip: %v", err)
+	release = acquire(workSlots.extract)
+	started := time.Now()
+	err = processFile(withArchiveKey(ctx, key), zipFile, link, c)
+	metrics.timing("zips.process", time.Since(started))
+	release()
+	if errors.Is(err, errUnrecognizedFormat) && looksLikeHTML(zipFile) {
+		discardFailedZip(f, link, key, zipFile, cache)
+		if *loginPagePolicy == loginPageFail {
+			return false, &DownloadError{Link: link, Op: "cannot download zip", Err: errLoginPage}
+		}
+		log.Printf("Skipping zip %s/%s: %v, re-authenticate", f.URL, link, errLoginPage)
+		return false, nil
+	}
+	if errors.Is(err, errUnrecognizedFormat) {
+		log.Printf("Skipping zip %s/%s: unrecognized format", f.URL, link)
+		discardFailedZip(f, link, key, zipFile, cache)
+		if _, err := c.Do("HSET", f.key(unrecognizedQueue), link, time.Now().Unix()); err != nil {
+			return false, &StoreError{Op: "cannot record unrecognized zip", Err: err}
 		}
+		return false, nil
+	}
+	if errors.Is(err, errQueueFull) {
+		log.Printf("Leaving the rest of zip %s/%s for a later run: %v", f.URL, link, err)
+		discardZip(f, key, zipFile, cache)
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		return false, requeueZip(c, f, link)
+	}
+	if errors.Is(err, errEntryLimit) {
+		log.Printf("Zip %s/%s has more xmls than -max-entries-per-archive, stopped after %d, not marking it as processed", f.URL, link, *maxEntriesPerArchive)
+		discardZip(f, key, zipFile, cache)
+		if _, err := c.Do("HSET", f.key(entryLimitedQueue), link, *maxEntriesPerArchive); err != nil {
+			return false, &StoreError{Op: "cannot record entry limited zip", Err: err}
+		}
+		return false, nil
+	}
+	if err != nil {
+		discardFailedZip(f, link, key, zipFile, cache)
+		return false, fmt.Errorf("while processing zip: %w", err)
+	}
 
-		_, err = c.Do("HSET", downloadedQueue, link, link)
-		if err != nil {
-			fail <- fmt.Errorf("cannot set downloaded queue: %v", err)
+	if err := markDownloaded(c, f, key, link); err != nil {
+		discardFailedZip(f, link, key, zipFile, cache)
+		return false, err
+	}
+
+	discardZip(f, key, zipFile, cache)
+	return true, nil
+}
+
+// skipForError logs and records that the zip at link of feed f is skipped
+// if err getting it is one zips are skipped for, it returns err otherwise.
+func skipForError(c redis.Conn, f *Feed, link string, err error) error {
+	var hostErr *HostError
+	if errors.As(err, &hostErr) {
+		log.Printf("Skipping zip %s/%s: %v", f.URL, link, hostErr)
+		return nil
+	}
+	if errors.Is(err, errRetryBudgetExhausted) && *retryBudgetPolicy == retryBudgetSkip {
+		log.Printf("Skipping zip %s/%s: %v", f.URL, link, err)
+		return nil
+	}
+	var sizeErr *SizeError
+	if errors.As(err, &sizeErr) {
+		return skipForSize(c, f, link, sizeErr)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case goneStatuses.has(statusErr.Code):
+			log.Printf("Skipping zip %s/%s: gone, %v", f.URL, link, statusErr)
+			if _, err := c.Do("HSET", f.key(goneQueue), link, statusErr.Code); err != nil {
+				return &StoreError{Op: "cannot record gone zip", Err: err}
+			}
+			return nil
+		case !retryStatuses.has(statusErr.Code) && *otherStatusPolicy == statusPolicySkip:
+			log.Printf("Skipping zip %s/%s: %v", f.URL, link, statusErr)
+			return nil
 		}
+	}
+	return err
+}
+
+// skipForSize logs and records that the zip at link of feed f is skipped
+// for its size.
+func skipForSize(c redis.Conn, f *Feed, link string, sizeErr *SizeError) error {
+	log.Printf("Skipping zip %s/%s: %v", f.URL, link, sizeErr)
+	if _, err := c.Do("HSET", f.key(sizeSkippedQueue), link, sizeErr.Size); err != nil {
+		return &StoreError{Op: "cannot record skipped zip", Err: err}
+	}
+	return nil
+}
+
+// discardZip removes the local copy of the zip of feed f recorded under
+// key, the zip is only kept around while it might need to be processed
+// again.
+func discardZip(f *Feed, key, zipFile string, cache *archiveCache) {
+	if *localDir != "" {
+		return
+	}
+	if cache != nil {
+		cache.remove(f.key(key))
+		return
+	}
+	removeArchiveFile(zipFile)
+}
 
-		// even though these actions are deferred for cases where there is a
-		// non clean exit from the function, we should close them in each loop end
-		// to avoid memory leaking.
-		os.Remove(tempFile.Name())
-		response.Body.Close()
+// discardFailedZip disposes of the local copy of a zip that could not be
+// processed. It is kept with -keep-failed for inspection, and in the cache
+// so the next run does not download it again.
+func discardFailedZip(f *Feed, link, key, zipFile string, cache *archiveCache) {
+	if *localDir != "" {
+		return
+	}
+	if *keepFailed {
+		log.Printf("Keeping zip %s/%s that failed to process at %s", f.URL, link, zipFile)
+	}
+	switch {
+	case cache != nil:
+		cache.release(f.key(key))
+	case !*keepFailed:
+		removeArchiveFile(zipFile)
 	}
 }
 
-// extractLink obtains href from a list of attributes
-func extractLink(attrs []html.Attribute) string {
-	for _, attr := range attrs {
-		if attr.Key == hrefAttr {
-			return attr.Val
+// tempPattern returns the temp file name pattern for the zip at link, so
+// local copies can be told apart by the link they came from.
+func tempPattern(link string) string {
+	name := path.Base(link)
+	if len(name) > maxTempNameLen {
+		name = name[len(name)-maxTempNameLen:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+	return "zip-" + name + "-*"
+}
+
+// fetchZip returns the path to a local copy of the zip at link of feed f,
+// reusing the one cached under key in the namespace of f if present,
+// otherwise downloading it until ctx is done. With -local-dir the zip is
+// already local.
+func fetchZip(ctx context.Context, f *Feed, link, key string, cache *archiveCache) (string, error) {
+	if *localDir != "" {
+		return localArchive(link), nil
+	}
+	dir := ""
+	if cache != nil {
+		if cached, ok := cache.get(f.key(key)); ok {
+			log.Printf("Using cached zip for %s/%s", f.URL, link)
+			return cached, nil
+		}
+		dir = cache.dir
+	}
+
+	zipURL := archiveURL(f, link)
+	u, err := url.Parse(zipURL)
+	if err != nil {
+		return "", &DownloadError{Link: link, Op: "cannot parse zip url", Err: err}
+	}
+	if err := checkHost(u.Hostname()); err != nil {
+		return "", err
+	}
+
+	pattern := tempPattern(link)
+	if *spoolCompress {
+		pattern += spoolSuffix
+	}
+	tempFile, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return "", &DownloadError{Link: link, Op: "cannot open tempfile to write zip", Err: err}
+	}
+	spool := newSpoolFile(tempFile)
+	defer spool.Close()
+
+	release := hostSlots.acquire(u.Hostname())
+	defer release()
+	log.Printf("Downloading zip %s/%s", f.URL, link)
+	// lets get the contents into a file, we dont know the size
+	// and therefore are not sure if we can hold many of these
+	// in memory.
+	started := time.Now()
+	err = downloadTo(ctx, spool, zipURL)
+	metrics.timing("zips.download", time.Since(started))
+	if err != nil {
+		spool.Close()
+		removeArchiveFile(tempFile.Name())
+		return "", &DownloadError{Link: link, Op: "cannot download zip", Err: err}
+	}
+	if err := spool.Close(); err != nil {
+		removeArchiveFile(tempFile.Name())
+		return "", &DownloadError{Link: link, Op: "cannot write zip into temp file", Err: err}
+	}
+	atomic.AddInt64(&runStats.downloaded, 1)
+	metrics.count("zips.downloaded", 1)
+	if cache == nil {
+		return tempFile.Name(), nil
+	}
+	cached, err := cache.put(f.key(key), tempFile.Name())
+	if err != nil {
+		return "", &DownloadError{Link: link, Op: "cannot move zip into cache", Err: err}
+	}
+	return cached, nil
+}
+
+// jitter returns a random duration in [0, max), it is added to waits that
+// would otherwise be the same for every worker.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// backoff returns the wait before retry number attempt, doubling from base
+// with added jitter so workers retrying at once spread out.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	return d + jitter(d/2)
+}
+
+// extractLink returns the link held by token, looking at the attributes
+// -link-attr lists for its tag.
+func extractLink(token html.Token) string {
+	for _, key := range linkSources[token.Data] {
+		for _, attr := range token.Attr {
+			if attr.Key == key {
+				return attr.Val
+			}
 		}
 	}
 	return ""
 }
 
 // downloadLinksList extracts a list of links to zip files from the given
-// url and feeds them to the passed links channel.
-func downloadLinksList(url string, links chan string, fail chan error, done chan struct{}) {
-	response, err := http.Get(url)
+// url, and the -index-pattern pages it links to, and feeds them to the
+// passed links channel, which is closed once the whole list was read.
+func downloadLinksList(ctx context.Context, url string, links chan string, fail chan error) {
+	defer close(links)
+	if err := readLinksPage(ctx, url, 0, map[string]bool{url: true}, links); err != nil && ctx.Err() == nil {
+		fail <- err
+	}
+}
+
+// readLinksPage feeds the links to zip files in the html page at url,
+// depth levels below the feed, to links, following the index pages it
+// links to unless already seen. Links below the feed are resolved against
+// their page.
+func readLinksPage(ctx context.Context, url string, depth int, seen map[string]bool, links chan string) error {
+	if depth > 0 {
+		log.Printf("Reading index page %s", url)
+	}
+	response, err := fetchListing(ctx, url)
 	if err != nil {
-		fail <- fmt.Errorf("cannot process url: %v", err)
+		return &DownloadError{Link: url, Op: "cannot process url", Err: err}
 	}
-	defer response.Body.Close()
+	defer closeBody(response.Body)
 	log.Println("Succesful connection")
 	tokenizer := html.NewTokenizer(response.Body)
 	log.Println("Start parsing")
-	for {
+	// parsing is how long was spent in the tokenizer, which includes
+	// reading the page but not waiting for the workers to take links.
+	var parsing time.Duration
+	for tokens := 1; ; tokens++ {
+		started := time.Now()
 		tokenType := tokenizer.Next()
+		parsing += time.Since(started)
+		if *listingMaxTokens > 0 && tokens > *listingMaxTokens {
+			log.Printf("Listing %s is longer than %d tokens, giving up on it", url, *listingMaxTokens)
+			return &DownloadError{Link: url, Op: "cannot parse links list", Err: fmt.Errorf("more than %d tokens", *listingMaxTokens)}
+		}
+		if *listingParseTime > 0 && parsing > *listingParseTime {
+			log.Printf("Listing %s took longer than %v to parse, giving up on it", url, *listingParseTime)
+			return &DownloadError{Link: url, Op: "cannot parse links list", Err: fmt.Errorf("parse took longer than %v", *listingParseTime)}
+		}
 		switch tokenType {
 		case html.ErrorToken:
-			done <- struct{}{}
-		case html.StartTagToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return &DownloadError{Link: url, Op: "cannot parse links list", Err: err}
+			}
+			return nil
+		case html.CommentToken, html.DoctypeToken:
+			// never hold links, not even in broken pages.
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
 			// gets the current token
 			token := tokenizer.Token()
-			if token.Data != "a" {
+			link := extractLink(token)
+			if len(link) < minProtocolLen {
 				continue
 			}
-			link := extractLink(token.Attr)
-			if len(link) < minProtocolLen {
+			archive, index := isArchiveLink(link), !isArchiveLink(link) && isIndexLink(link, depth)
+			if !archive && !index {
+				continue
+			}
+			if depth > 0 || index {
+				resolved, err := resolveLink(url, link)
+				if err != nil {
+					debugf("Cannot resolve link %q of %s: %v", link, url, err)
+					continue
+				}
+				link = resolved
+			}
+			if archive {
+				if !emitLink(ctx, links, link) {
+					return ctx.Err()
+				}
+				continue
+			}
+			if seen[link] {
+				debugf("Index page %s was already read, not following it again", link)
 				continue
 			}
-			if strings.HasSuffix(link, zipSuffix) {
-				links <- link
+			seen[link] = true
+			if err := readLinksPage(ctx, link, depth+1, seen, links); err != nil {
+				return err
 			}
 		}
 	}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeConn is an in memory redis.Conn implementing just the commands the
+// extraction path uses.
+type fakeConn struct {
+	hashes map[string]map[string]string
+	lists  map[string][]string
+	sets   map[string]map[string]bool
+	keys   map[string]string
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		hashes: map[string]map[string]string{},
+		lists:  map[string][]string{},
+		sets:   map[string]map[string]bool{},
+		keys:   map[string]string{},
+	}
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "HGET":
+		v, ok := c.hashes[args[0].(string)][args[1].(string)]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(v), nil
+	case "HSET":
+		h := c.hashes[args[0].(string)]
+		if h == nil {
+			h = map[string]string{}
+			c.hashes[args[0].(string)] = h
+		}
+		h[args[1].(string)] = args[2].(string)
+		return int64(1), nil
+	case "SET":
+		// only SET key value NX, as used for claims.
+		key := args[0].(string)
+		if _, ok := c.keys[key]; ok {
+			return nil, nil
+		}
+		c.keys[key] = fmt.Sprint(args[1])
+		return "OK", nil
+	case "ZADD":
+		return int64(1), nil
+	case "LPUSH":
+		key := args[0].(string)
+		c.lists[key] = append(c.lists[key], string(args[1].([]byte)))
+		return int64(len(c.lists[key])), nil
+	case "LLEN":
+		return int64(len(c.lists[args[0].(string)])), nil
+	case "BRPOPLPUSH":
+		// lists are kept tail first, as LPUSH appends.
+		src, dst := args[0].(string), args[1].(string)
+		if len(c.lists[src]) == 0 {
+			return nil, nil
+		}
+		v := c.lists[src][0]
+		c.lists[src] = c.lists[src][1:]
+		c.lists[dst] = append(c.lists[dst], v)
+		return []byte(v), nil
+	case "LREM":
+		key := args[0].(string)
+		for i, v := range c.lists[key] {
+			if v == args[2].(string) {
+				c.lists[key] = append(c.lists[key][:i], c.lists[key][i+1:]...)
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	case "SADD":
+		key, member := args[0].(string), args[1].(string)
+		if c.sets[key] == nil {
+			c.sets[key] = map[string]bool{}
+		}
+		if c.sets[key][member] {
+			return int64(0), nil
+		}
+		c.sets[key][member] = true
+		return int64(1), nil
+	case "SREM":
+		key, member := args[0].(string), args[1].(string)
+		if !c.sets[key][member] {
+			return int64(0), nil
+		}
+		delete(c.sets[key], member)
+		return int64(1), nil
+	}
+	return nil, fmt.Errorf("fakeConn: unsupported command %s", cmd)
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error { return nil }
+func (c *fakeConn) Flush() error                               { return nil }
+func (c *fakeConn) Receive() (interface{}, error)              { return nil, nil }
+func (c *fakeConn) Close() error                               { return nil }
+func (c *fakeConn) Err() error                                 { return nil }
+
+// zipFixture returns an in memory zip with count deflated xml entries of
+// size bytes.
+func zipFixture(tb testing.TB, count, size int) *zip.Reader {
+	return zipFixtureMethod(tb, count, size, zip.Deflate)
+}
+
+// zipFixtureMethod is zipFixture with entries compressed with method.
+func zipFixtureMethod(tb testing.TB, count, size int, method uint16) *zip.Reader {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	body := bytes.Repeat([]byte("<a>news</a>"), size/len("<a>news</a>")+1)[:size]
+	for i := 0; i < count; i++ {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("entry-%d.xml", i), Method: method})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := f.Write(body); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+// zipBytes returns the raw bytes of a zip with count xml entries of size
+// bytes.
+func zipBytes(tb testing.TB, count, size int) []byte {
+	r := zipFixture(tb, count, size)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range r.File {
+		if err := w.Copy(f); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkProcessArchive(b *testing.B, count, size int) {
+	benchmarkProcessArchiveMethod(b, count, size, zip.Deflate)
+}
+
+func benchmarkProcessArchiveMethod(b *testing.B, count, size int, method uint16) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	r := zipFixtureMethod(b, count, size, method)
+	b.SetBytes(int64(count * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// a fresh conn each time so nothing is skipped as processed.
+		if err := processArchive(context.Background(), r, "bench.zip", newFakeConn()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessArchive1x1MB(b *testing.B)      { benchmarkProcessArchive(b, 1, 1<<20) }
+func BenchmarkProcessArchive10x1MB(b *testing.B)     { benchmarkProcessArchive(b, 10, 1<<20) }
+func BenchmarkProcessArchive100x64KB(b *testing.B)   { benchmarkProcessArchive(b, 100, 64<<10) }
+func BenchmarkProcessArchive1000x1KB(b *testing.B)   { benchmarkProcessArchive(b, 1000, 1<<10) }
+func BenchmarkProcessArchive10000x100B(b *testing.B) { benchmarkProcessArchive(b, 10000, 100) }
+
+func BenchmarkProcessArchiveStored10x1MB(b *testing.B) {
+	benchmarkProcessArchiveMethod(b, 10, 1<<20, zip.Store)
+}
+func BenchmarkProcessArchiveStored1000x1KB(b *testing.B) {
+	benchmarkProcessArchiveMethod(b, 1000, 1<<10, zip.Store)
+}
+
+func TestDownloadStartsBeforeListingIsParsed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	zipData := zipBytes(t, 1, 100)
+	downloadStarted := make(chan struct{})
+	var once sync.Once
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, zipSuffix) {
+			once.Do(func() { close(downloadStarted) })
+			w.Write(zipData)
+			return
+		}
+		fmt.Fprintf(w, `<html><body><a href="%s/first.zip">first</a>`, srv.URL)
+		w.(http.Flusher).Flush()
+		// the rest of the listing is only sent once the first zip is
+		// being downloaded, or after giving up on that.
+		select {
+		case <-downloadStarted:
+		case <-time.After(10 * time.Second):
+			t.Error("listing was fully served before the first download started")
+		}
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, `<a href="%s/zip-%d.zip">zip</a>`, srv.URL, i)
+		}
+		fmt.Fprint(w, `</body></html>`)
+	}))
+	defer srv.Close()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return newFakeConn(), nil },
+	}
+	if err := crawl(context.Background(), []*Feed{{URL: srv.URL, Type: feedTypeHTML}}, pool, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamHandsOverEntries(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	sink := output
+
+	zipData := zipBytes(t, 3, 100)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, zipSuffix) {
+			w.Write(zipData)
+			return
+		}
+		fmt.Fprintf(w, `<html><body><a href="%s/news.zip">news</a></body></html>`, srv.URL)
+	}))
+	defer srv.Close()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return newFakeConn(), nil },
+	}
+	entries, errs := Stream(context.Background(), StreamOptions{
+		Feeds: []*Feed{{URL: srv.URL, Type: feedTypeHTML}},
+		Pool:  pool,
+	})
+	var names []string
+	for e := range entries {
+		names = append(names, e.Name)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("got entries %v, expected 3", names)
+	}
+	if output != sink {
+		t.Fatal("Stream replaced the sink of the process")
+	}
+}
+
+func TestDuplicateEntryNamesAreAllPushed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, body := range []string{"<a>first</a>", "<a>second</a>"} {
+		f, err := w.Create("news.xml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeConn()
+	if err := processArchive(context.Background(), r, "dup.zip", c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.lists[redisKey(*outputQueue)]; len(got) != 2 {
+		t.Fatalf("pushed %q, expected both xmls", got)
+	}
+	processed := c.hashes[redisKey(processedQueue)]
+	if _, ok := processed[entryKey("dup.zip", "news~2.xml")]; !ok {
+		t.Fatalf("second xml is not recorded as news~2.xml, processed: %v", processed)
+	}
+}
+
+func TestWorkQueueHandsOverLinks(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	zipData := zipBytes(t, 2, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(zipData)
+	}))
+	defer srv.Close()
+	f := &Feed{URL: srv.URL, Type: feedTypeHTML}
+
+	c := newFakeConn()
+	queued, err := queueLink(context.Background(), c, Link{URL: "news.zip", Feed: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queued {
+		t.Fatal("news.zip is not reported as handed over")
+	}
+	if len(c.sets[queuedKey()]) != 1 {
+		t.Fatalf("queued links are %v, expected news.zip", c.sets[queuedKey()])
+	}
+	const id = "test"
+	record, err := redis.String(c.Do("BRPOPLPUSH", redisKey(*workQueue), processingKey(id), workPollSeconds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := doWork(context.Background(), c, map[string]*Feed{f.URL: f}, id, record, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.lists[redisKey(*outputQueue)]; len(got) != 2 {
+		t.Fatalf("pushed %q, expected both xmls", got)
+	}
+	if len(c.sets[queuedKey()]) != 0 {
+		t.Fatalf("news.zip is still marked as queued: %v", c.sets[queuedKey()])
+	}
+	if got := c.lists[processingKey(id)]; len(got) != 0 {
+		t.Fatalf("processing list still holds %q", got)
+	}
+}
+
+func TestReloadResizesWorkerSlots(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(s stageSlots) { workSlots, stagedWorkers = s, 0 }(workSlots)
+
+	if err := setupWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	if n := workerCount(); n != zipConcurrency {
+		t.Fatalf("%d workers before the reload, expected %d", n, zipConcurrency)
+	}
+	if err := resizeSlots(workSlots.download, "5"); err != nil {
+		t.Fatal(err)
+	}
+	if n := workerCount(); n != 5+zipConcurrency {
+		t.Fatalf("%d workers after the reload, expected %d", n, 5+zipConcurrency)
+	}
+	// every slot can be taken at once.
+	var releases []func()
+	for i := 0; i < 5; i++ {
+		releases = append(releases, acquire(workSlots.download))
+	}
+	for _, release := range releases {
+		release()
+	}
+}
+
+func TestNewZipVersionIsPushedAgain(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(s string) { *dedupStrategy = s }(*dedupStrategy)
+	*dedupStrategy = dedupLinkMtime
+
+	zipData := zipBytes(t, 2, 100)
+	modified := "Mon, 01 Feb 2016 10:00:00 GMT"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", modified)
+		w.Write(zipData)
+	}))
+	defer srv.Close()
+	f := &Feed{URL: srv.URL, Type: feedTypeHTML}
+
+	c := newFakeConn()
+	run := func() {
+		// a fresh run, which claims the link anew.
+		c.keys = map[string]string{}
+		if _, err := processLink(context.Background(), Link{URL: "news.zip", Feed: f}, c, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run()
+	run()
+	if got := c.lists[redisKey(*outputQueue)]; len(got) != 2 {
+		t.Fatalf("pushed %d xmls, expected the unchanged zip to be skipped", len(got))
+	}
+	modified = "Tue, 02 Feb 2016 10:00:00 GMT"
+	run()
+	if got := c.lists[redisKey(*outputQueue)]; len(got) != 4 {
+		t.Fatalf("pushed %d xmls, expected those of the new version too", len(got))
+	}
+}
+
+func TestCursorHoldsPagesOfUnprocessedZips(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	zipData := zipBytes(t, 1, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// empty.zip comes back empty, to be retried next run.
+		if strings.HasSuffix(r.URL.Path, "/news.zip") {
+			w.Write(zipData)
+		}
+	}))
+	defer srv.Close()
+
+	c := newFakeConn()
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) { return c, nil },
+	}
+	f := &Feed{URL: srv.URL, Type: feedTypeJSON}
+	f.cursor = newPageCursor(f, pool)
+	links := make(chan Link, 2)
+	for i, link := range []string{"news.zip", "empty.zip"} {
+		pg := f.cursor.startPage(fmt.Sprintf("%s/page-%d", srv.URL, i+1))
+		f.cursor.add(pg, link)
+		f.cursor.pageRead(pg, "", false)
+		links <- Link{URL: link, Feed: f}
+	}
+	close(links)
+	processLinks(context.Background(), links, make(chan error, 1), pool, nil)
+
+	record := c.hashes[f.key(feedCursorsQueue)][f.URL]
+	if !strings.Contains(record, "/page-1") {
+		t.Fatalf("cursor saved as %q, expected it left at the first page", record)
+	}
+}
+
+func TestSizedDeadline(t *testing.T) {
+	defer func(timeout time.Duration, throughput int64) {
+		*linkTimeout, *linkThroughput = timeout, throughput
+	}(*linkTimeout, *linkThroughput)
+	*linkTimeout, *linkThroughput = 0, 1<<20
+
+	d := newLinkDeadline(context.Background())
+	d.sized(3 << 19)
+	if d.limit != 1500*time.Millisecond {
+		t.Fatalf("got %v to download 1.5MB at 1MB/s, expected 1.5s", d.limit)
+	}
+	d.stop()
+
+	d = newLinkDeadline(context.Background())
+	defer d.stop()
+	d.sized(0)
+	time.Sleep(10 * time.Millisecond)
+	if d.expired() {
+		t.Fatalf("an empty zip was cut at a deadline of %v", d.limit)
+	}
+}
+
+func TestDownloadStopsWithTheCrawl(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("PK"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	tempFile, err := ioutil.TempFile("", "zip-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+	spool := newSpoolFile(tempFile)
+	defer spool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	errc := make(chan error, 1)
+	go func() { errc <- downloadTo(ctx, spool, srv.URL+"/news.zip") }()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("got %v, expected the download cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("download went on after the crawl was cancelled")
+	}
+}
+
+func TestCancelWakesPausedWorkers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer workPause.set(false)
+
+	workPause.set(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	links := make(chan Link, 1)
+	links <- Link{URL: "news.zip"}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		processLinks(ctx, links, make(chan error, 1), &redis.Pool{
+			Dial: func() (redis.Conn, error) { return newFakeConn(), nil },
+		}, nil)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("paused worker did not stop once cancelled")
+	}
+}
+
+func TestFullRoutedQueueHoldsPushes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(max int64, policy string, queues map[string]string) {
+		*maxQueueLen, *queueFullPolicy, typeQueues = max, policy, queues
+	}(*maxQueueLen, *queueFullPolicy, typeQueues)
+	*maxQueueLen, *queueFullPolicy = 1, queueFullRequeue
+	typeQueues = map[string]string{".xml": "NEWS_XML"}
+
+	c := newFakeConn()
+	c.lists[redisKey("NEWS_XML")] = []string{"<a/>", "<b/>"}
+	err := processArchive(context.Background(), zipFixture(t, 1, 100), "news.zip", c)
+	if !errors.Is(err, errQueueFull) {
+		t.Fatalf("got %v, expected the full NEWS_XML queue to hold the push", err)
+	}
+	if got := c.lists[redisKey("NEWS_XML")]; len(got) != 2 {
+		t.Fatalf("NEWS_XML holds %d xmls, expected nothing pushed to it", len(got))
+	}
+}
+
+func TestManifestLinkKeepsAtSigns(t *testing.T) {
+	defer func(s string) { *dedupStrategy = s }(*dedupStrategy)
+	*dedupStrategy = dedupLinkMtime
+
+	for key, link := range map[string]string{
+		`https://host/news.zip@"abc"`:                         "https://host/news.zip",
+		`https://host/news.zip@W/"abc"`:                       "https://host/news.zip",
+		"https://host/news.zip@Mon, 01 Feb 2016 10:00:00 GMT": "https://host/news.zip",
+		"https://user@host/news.zip":                          "https://user@host/news.zip",
+		`https://user@host/a@b/news.zip@"abc"`:                "https://user@host/a@b/news.zip",
+	} {
+		if got := manifestLink(key); got != link {
+			t.Errorf("manifestLink(%q) = %q, expected %q", key, got, link)
+		}
+	}
+}
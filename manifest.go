@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const feedTypeManifest = "manifest"
+
+var manifestPrune = flag.Bool("manifest-prune", false, "with -feed-type=manifest, forget the downloaded zips the manifest no longer lists, so they are processed again if they come back; only for feeds that do not share their namespace with other feeds")
+
+// manifestArchive is an element of the archives list of a manifest.
+type manifestArchive struct {
+	URL string `json:"url"`
+	// Size is the size of the archive in bytes, 0 if not published.
+	Size int64 `json:"size"`
+	// SHA256 is the hex sha256 of the archive, empty if not published.
+	SHA256 string `json:"sha256"`
+}
+
+// feedManifest holds the archives listed by the manifest of a feed, by
+// resolved url, for downloads to be verified against. A nil manifest
+// lists nothing.
+type feedManifest struct {
+	mu       sync.Mutex
+	feed     *Feed
+	pool     *redis.Pool
+	archives map[string]manifestArchive
+}
+
+func newFeedManifest(f *Feed, pool *redis.Pool) *feedManifest {
+	return &feedManifest{feed: f, pool: pool, archives: map[string]manifestArchive{}}
+}
+
+// lookup returns what the manifest lists for the archive at link.
+func (m *feedManifest) lookup(link string) (manifestArchive, bool) {
+	if m == nil {
+		return manifestArchive{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.archives[link]
+	return a, ok
+}
+
+// downloadManifestLinks reads the manifest.json at manifestURL, records
+// its archives in m and feeds their urls to links, which is closed once
+// done. The manifest is the whole listing of the feed, as in
+// {"archives": [{"url": "...", "size": 123, "sha256": "..."}]}.
+func downloadManifestLinks(ctx context.Context, manifestURL string, m *feedManifest, links chan string, fail chan error) {
+	defer close(links)
+	listed, archives, err := readManifest(ctx, manifestURL)
+	if err != nil {
+		if ctx.Err() == nil {
+			fail <- err
+		}
+		return
+	}
+	log.Printf("Manifest %s lists %d archives", manifestURL, len(archives))
+	if m != nil {
+		m.mu.Lock()
+		for link, a := range archives {
+			m.archives[link] = a
+		}
+		m.mu.Unlock()
+		if *manifestPrune {
+			if err := m.prune(archives); err != nil {
+				fail <- err
+				return
+			}
+		}
+	}
+	for _, link := range listed {
+		if !hasArchiveExt(link) {
+			continue
+		}
+		if !emitLink(ctx, links, link) {
+			return
+		}
+	}
+}
+
+// readManifest returns the urls of the archives of the manifest at
+// manifestURL in the order listed, resolved against the manifest, and the
+// archives by url.
+func readManifest(ctx context.Context, manifestURL string) ([]string, map[string]manifestArchive, error) {
+	response, err := fetchListing(ctx, manifestURL)
+	if err != nil {
+		return nil, nil, &DownloadError{Link: manifestURL, Op: "cannot get manifest", Err: err}
+	}
+	defer closeBody(response.Body)
+	parseErr := func(err error) error {
+		return &DownloadError{Link: manifestURL, Op: "cannot parse manifest", Err: err}
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, nil, parseErr(err)
+	}
+	var manifest struct {
+		Archives []manifestArchive `json:"archives"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&manifest); err != nil {
+		return nil, nil, parseErr(err)
+	}
+	var listed []string
+	archives := make(map[string]manifestArchive, len(manifest.Archives))
+	for _, a := range manifest.Archives {
+		ref, err := url.Parse(a.URL)
+		if err != nil || a.URL == "" {
+			return nil, nil, parseErr(fmt.Errorf("invalid url %q", a.URL))
+		}
+		if a.SHA256 != "" {
+			a.SHA256 = strings.ToLower(a.SHA256)
+			if b, err := hex.DecodeString(a.SHA256); err != nil || len(b) != sha256.Size {
+				return nil, nil, parseErr(fmt.Errorf("invalid sha256 for %s", a.URL))
+			}
+		}
+		link := base.ResolveReference(ref).String()
+		if _, ok := archives[link]; !ok {
+			listed = append(listed, link)
+		}
+		archives[link] = a
+	}
+	return listed, archives, nil
+}
+
+// prune forgets the downloaded zips of the feed that archives does not
+// list. An empty manifest prunes nothing, it is more likely broken than
+// the feed empty.
+func (m *feedManifest) prune(archives map[string]manifestArchive) error {
+	if len(archives) == 0 {
+		log.Println("Manifest lists no archives, not pruning")
+		return nil
+	}
+	c := m.pool.Get()
+	defer c.Close()
+	var stale []string
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("HSCAN", m.feed.key(downloadedQueue), cursor, "COUNT", 1000))
+		if err != nil {
+			return &StoreError{Op: "cannot scan downloaded zips", Err: err}
+		}
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return &StoreError{Op: "cannot scan downloaded zips", Err: err}
+		}
+		fields, err := redis.Strings(values[1], nil)
+		if err != nil {
+			return &StoreError{Op: "cannot scan downloaded zips", Err: err}
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if _, ok := archives[manifestLink(fields[i])]; !ok {
+				stale = append(stale, fields[i])
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for _, key := range stale {
+		if _, err := c.Do("HDEL", m.feed.key(downloadedQueue), key); err != nil {
+			return &StoreError{Op: "cannot prune downloaded zip", Err: err}
+		}
+		if _, err := c.Do("ZREM", m.feed.key(downloadedAtQueue), key); err != nil {
+			return &StoreError{Op: "cannot prune downloaded zip", Err: err}
+		}
+	}
+	if len(stale) > 0 {
+		log.Printf("Pruned %d downloaded zips no longer in the manifest", len(stale))
+	}
+	return nil
+}
+
+// manifestLink returns the link a zip was recorded as downloaded under
+// key, without the version -dedup=link-mtime adds. Links may hold an @ of
+// their own, so only a suffix shaped as the versions dedupKey adds is
+// taken for one.
+func manifestLink(key string) string {
+	if *dedupStrategy != dedupLinkMtime {
+		return key
+	}
+	for i := strings.Index(key, "@"); i >= 0; {
+		if isZipVersion(key[i+1:]) {
+			return key[:i]
+		}
+		next := strings.Index(key[i+1:], "@")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return key
+}
+
+// isZipVersion reports whether v is an ETag or an http date, as dedupKey
+// versions zips with.
+func isZipVersion(v string) bool {
+	etag := strings.TrimPrefix(v, "W/")
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		return true
+	}
+	_, err := http.ParseTime(v)
+	return err == nil
+}
+
+// verifyManifest reports whether the local copy of a zip at zipFile
+// matches the size and sha256 the manifest lists for it as a.
+func verifyManifest(a manifestArchive, zipFile string) (bool, error) {
+	if a.Size > 0 {
+		size, err := archiveFileSize(zipFile)
+		if err != nil {
+			return false, err
+		}
+		if size != a.Size {
+			return false, nil
+		}
+	}
+	if a.SHA256 == "" {
+		return true, nil
+	}
+	fd, err := openArchiveFile(zipFile)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == a.SHA256, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"sync"
+)
+
+var memBudget = flag.Int64("mem-budget", 0, "bytes of xml buffered at once across all workers, workers wait for room before reading an entry; 0 for no limit")
+
+// byteBudget bounds the bytes of entries held in memory at once.
+type byteBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+func newByteBudget() *byteBudget {
+	b := &byteBudget{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+var entryMemory = newByteBudget()
+
+// acquire waits until n bytes fit in -mem-budget and reserves them,
+// returning how many were reserved for release. An entry larger than the
+// whole budget waits until nothing else is held.
+func (b *byteBudget) acquire(n int64) int64 {
+	if *memBudget <= 0 || n <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > *memBudget {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+// release gives back n bytes reserved by acquire.
+func (b *byteBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// archiveContentTypes are the part content types taken for an archive in
+// multipart responses.
+var archiveContentTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-tar":            true,
+	"application/octet-stream":     true,
+}
+
+// errNoArchivePart is returned for multipart responses none of whose parts
+// is an archive.
+var errNoArchivePart = errors.New("multipart response has no archive part")
+
+// responseArchive returns the reader of the archive in response: its body,
+// or for multipart responses, which some servers wrap archives in, the
+// first part that is an archive by its content type or file name. It
+// reports whether the response was multipart, which cannot be resumed.
+func responseArchive(response *http.Response) (io.Reader, bool, error) {
+	mediaType, params, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	// multipart/byteranges answers multiple ranges, which are not asked
+	// for.
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || mediaType == "multipart/byteranges" {
+		return response.Body, false, nil
+	}
+	if params["boundary"] == "" {
+		return nil, true, errors.New("multipart response has no boundary")
+	}
+	mr := multipart.NewReader(response.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, true, errNoArchivePart
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if archiveContentTypes[partType] || hasArchiveExt(part.FileName()) {
+			debugf("Taking part %q of type %s of multipart response as the archive", part.FileName(), partType)
+			return part, true, nil
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// feedCursorsQueue records, by feed url, the last page of paginated feeds
+// whose zips were all processed by a run that did not get to the end.
+const feedCursorsQueue = "feed-cursors"
+
+var fresh = flag.Bool("fresh", false, "list paginated feeds from their first page, ignoring the page an interrupted run left off at")
+
+// savedCursor is where an interrupted run left a paginated feed.
+type savedCursor struct {
+	Page string `json:"page"`
+	// Fingerprint identifies the archives the page listed, a page that
+	// lists others now means the feed shifted under the cursor.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// cursorPage is a page of a paginated feed being crawled.
+type cursorPage struct {
+	url         string
+	fingerprint string
+	pending     int
+	read        bool
+	last        bool
+}
+
+// pageCursor follows which pages of a paginated feed had all their zips
+// processed, saving the last of them so the next run can resume there.
+// Pages count as processed in order, a page with a failed zip holds back
+// every page after it. A nil cursor tracks nothing.
+type pageCursor struct {
+	mu    sync.Mutex
+	feed  *Feed
+	pool  *redis.Pool
+	pages []*cursorPage
+	links map[string]*cursorPage
+	done  int
+}
+
+func newPageCursor(f *Feed, pool *redis.Pool) *pageCursor {
+	return &pageCursor{feed: f, pool: pool, links: map[string]*cursorPage{}}
+}
+
+// resume returns where the last run left the feed, unless -fresh is set.
+func (p *pageCursor) resume() (savedCursor, bool) {
+	var saved savedCursor
+	if p == nil || *fresh {
+		return saved, false
+	}
+	c := p.pool.Get()
+	defer c.Close()
+	record, err := redis.Bytes(c.Do("HGET", p.feed.key(feedCursorsQueue), p.feed.URL))
+	if err == redis.ErrNil {
+		return saved, false
+	}
+	if err == nil {
+		err = json.Unmarshal(record, &saved)
+	}
+	if err != nil {
+		log.Printf("Cannot read where the last run left feed %s, listing it from its first page: %v", p.feed.URL, err)
+		return saved, false
+	}
+	return saved, saved.Page != ""
+}
+
+// startPage starts tracking the page at url, read after the previous one.
+func (p *pageCursor) startPage(url string) *cursorPage {
+	pg := &cursorPage{url: url}
+	if p == nil {
+		return pg
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pages = append(p.pages, pg)
+	return pg
+}
+
+// add records that link was listed in pg and is yet to be processed.
+func (p *pageCursor) add(pg *cursorPage, link string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.links[link]; ok {
+		return
+	}
+	p.links[link] = pg
+	pg.pending++
+}
+
+// pageRead records that every link of pg was listed, last tells whether
+// it is the last page of the feed.
+func (p *pageCursor) pageRead(pg *cursorPage, fingerprint string, last bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pg.fingerprint, pg.read, pg.last = fingerprint, true, last
+	p.advance()
+}
+
+// linkDone records that link was processed.
+func (p *pageCursor) linkDone(link string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pg, ok := p.links[link]
+	if !ok {
+		return
+	}
+	delete(p.links, link)
+	pg.pending--
+	p.advance()
+}
+
+// restart forgets the pages read so far, the feed is listed again from
+// its first page.
+func (p *pageCursor) restart() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pages, p.done = nil, 0
+	p.links = map[string]*cursorPage{}
+}
+
+// advance saves the last page processed along with every page before it,
+// or drops the saved cursor once that is the last page of the feed. It
+// must be called with p.mu held.
+func (p *pageCursor) advance() {
+	done := p.done
+	for done < len(p.pages) && p.pages[done].read && p.pages[done].pending == 0 {
+		done++
+	}
+	if done == p.done {
+		return
+	}
+	p.done = done
+	pg := p.pages[done-1]
+	c := p.pool.Get()
+	defer c.Close()
+	key := p.feed.key(feedCursorsQueue)
+	if pg.last {
+		if _, err := c.Do("HDEL", key, p.feed.URL); err != nil {
+			log.Printf("Cannot clear where the run left feed %s: %v", p.feed.URL, err)
+		}
+		return
+	}
+	record, err := json.Marshal(savedCursor{Page: pg.url, Fingerprint: pg.fingerprint})
+	if err == nil {
+		_, err = c.Do("HSET", key, p.feed.URL, string(record))
+	}
+	if err != nil {
+		log.Printf("Cannot save where the run left feed %s: %v", p.feed.URL, err)
+	}
+}
+
+// linkDone records that l was processed, for the page cursor of its feed.
+func (l Link) done() {
+	if l.Feed != nil {
+		l.Feed.cursor.linkDone(l.URL)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// pauser lets the crawl be held between zips, workers and the parser
+// call wait before starting on the next link.
+type pauser struct {
+	mu sync.Mutex
+	// resumed is closed once the crawl is resumed, nil while running.
+	resumed chan struct{}
+}
+
+func newPauser() *pauser {
+	return &pauser{}
+}
+
+var workPause = newPauser()
+
+// set pauses or resumes the crawl.
+func (p *pauser) set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if (p.resumed != nil) == paused {
+		return
+	}
+	if paused {
+		p.resumed = make(chan struct{})
+		log.Println("Paused, workers stop once their current zip is done")
+	} else {
+		close(p.resumed)
+		p.resumed = nil
+		log.Println("Resumed")
+	}
+}
+
+// toggle pauses the crawl if running and resumes it if paused.
+func (p *pauser) toggle() {
+	p.mu.Lock()
+	paused := p.resumed != nil
+	p.mu.Unlock()
+	p.set(!paused)
+}
+
+// wait blocks while the crawl is paused, or until ctx is done; callers
+// must check ctx afterwards.
+func (p *pauser) wait(ctx context.Context) {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var pollInterval = flag.Duration("poll", 0, "after each pass over the feeds wait this long and crawl them again, until interrupted; 0 crawls once and exits")
+
+// poll crawls feeds over and over, -poll apart as last reloaded, each
+// pass being a run of its own. Already processed zips are skipped as usual
+// so every pass only picks up the new ones. An interrupt lets the current
+// zips finish and stops, whether it comes during a pass or between two,
+// and so does ctx being done.
+func poll(ctx context.Context, feeds []*Feed, pool *redis.Pool, cache *archiveCache) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for pass := 1; ; pass++ {
+		if pass > 1 {
+			if err := resetRun(pass); err != nil {
+				log.Fatal(err)
+			}
+		}
+		result, err := runPass(ctx, feeds, pool, cache)
+		if ctx.Err() != nil {
+			log.Println("Interrupted, stopping")
+			return
+		}
+		switch {
+		case err != nil:
+			log.Printf("Pass failed: %v", err)
+		case result.EntriesPushed < int64(*minExpected):
+			log.Printf("Pushed %d new xmls, fewer than the %d expected by -min-expected", result.EntriesPushed, *minExpected)
+		}
+		wait := time.Duration(atomic.LoadInt64(&livePoll))
+		log.Printf("Crawling again in %v", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Println("Interrupted, stopping")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// resetRun starts pass afresh, with a new run id and zeroed counts. The
+// counters are reset in place, goroutines outliving the last pass may
+// still hold them.
+func resetRun(pass int) error {
+	runStart = time.Now()
+	runStats.reset()
+	runProgress.reset()
+	skippedZips.reset()
+	runErrors.reset()
+	runRetries.reset()
+	runClaims.reset()
+	return setupRunID(pass)
+}
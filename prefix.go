@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"io"
+)
+
+// truncatedQueue records the keys of xmls only pushed in part, with their
+// size, -1 if unknown.
+const truncatedQueue = "truncated"
+
+var entryPrefixBytes = flag.Int64("entry-prefix-bytes", 0, "push only the first this many bytes of every xml, for consumers after the header alone; cut xmls are recorded in the truncated hash and are not checked against their zip checksum. 0 pushes xmls whole")
+
+// prefixSize returns how much of an entry of the given size is read, size
+// is -1 if unknown.
+func prefixSize(size int64) int64 {
+	if *entryPrefixBytes > 0 && (size < 0 || size > *entryPrefixBytes) {
+		return *entryPrefixBytes
+	}
+	return size
+}
+
+// readPrefix reads the first n bytes of r, reporting whether there was
+// more to it.
+func readPrefix(r io.Reader, n int64) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(r, n+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(data)) > n {
+		return data[:n], true, nil
+	}
+	return data, false, nil
+}
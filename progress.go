@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const progressInterval = 5 * time.Second
+
+var showProgress = flag.Bool("progress", false, "periodically report processed zips, and an ETA once the whole listing was read; on a terminal as a line redrawn in place, best with -log-file and -log-stderr=false so log lines do not break into it")
+
+// progress counts the links and xmls of the current crawl, it is updated
+// atomically by the parser and the workers.
+type progress struct {
+	found  int64
+	done   int64
+	listed int32
+	pushed int64
+}
+
+var runProgress = &progress{}
+
+func (p *progress) linkFound()   { atomic.AddInt64(&p.found, 1) }
+func (p *progress) linkDone()    { atomic.AddInt64(&p.done, 1) }
+func (p *progress) listingDone() { atomic.StoreInt32(&p.listed, 1) }
+func (p *progress) entryPushed() { atomic.AddInt64(&p.pushed, 1) }
+
+// reset zeroes the counts for a new crawl.
+func (p *progress) reset() {
+	atomic.StoreInt64(&p.found, 0)
+	atomic.StoreInt64(&p.done, 0)
+	atomic.StoreInt32(&p.listed, 0)
+	atomic.StoreInt64(&p.pushed, 0)
+}
+
+// pushedEntries returns how many xmls were pushed so far.
+func (p *progress) pushedEntries() int64 { return atomic.LoadInt64(&p.pushed) }
+
+// report prints the progress every progressInterval until stop is closed.
+// On a terminal it redraws a single line, otherwise it logs.
+func (p *progress) report(stop chan struct{}) {
+	tty := isTerminal(os.Stderr)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	last, lastTime := atomic.LoadInt64(&p.done), time.Now()
+	// rate is the smoothed throughput in links per second.
+	var rate float64
+	for {
+		select {
+		case <-stop:
+			if tty {
+				fmt.Fprintln(os.Stderr)
+			}
+			return
+		case now := <-ticker.C:
+			done := atomic.LoadInt64(&p.done)
+			found := atomic.LoadInt64(&p.found)
+			recent := float64(done-last) / now.Sub(lastTime).Seconds()
+			if rate == 0 {
+				rate = recent
+			} else {
+				rate = 0.3*recent + 0.7*rate
+			}
+			last, lastTime = done, now
+
+			var line string
+			if atomic.LoadInt32(&p.listed) == 0 {
+				line = fmt.Sprintf("Processed %d zips, %d found so far", done, found)
+			} else {
+				line = fmt.Sprintf("Processed %d/%d zips", done, found)
+				if rate > 0 {
+					eta := time.Duration(float64(found-done)/rate) * time.Second
+					line += fmt.Sprintf(", about %v left", eta)
+				}
+			}
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+			} else {
+				log.Print(line)
+			}
+		}
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
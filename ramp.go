@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+)
+
+var rampUp = flag.Duration("ramp", 0, "start the workers one by one, evenly spread over this long, instead of all at once")
+
+// rampWait holds back worker number i, of n, until its turn in the ramp
+// up comes. It returns false if ctx is done before that.
+func rampWait(ctx context.Context, i, n int) bool {
+	if *rampUp <= 0 || i == 0 {
+		return true
+	}
+	t := time.NewTimer(*rampUp * time.Duration(i) / time.Duration(n-1))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return false
+	}
+	log.Printf("Ramping up, %d of %d workers running", i+1, n)
+	return true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// downloadedAtQueue is a sorted set of the downloaded zips by the unix
+// time they were recorded as downloaded.
+const downloadedAtQueue = "zips-at"
+
+var recheckSince = flag.Duration("recheck-since", 0, "process again the zips recorded as downloaded within this long, pushing whatever xmls of them are missing; a recovery tool for runs that crashed half way, 0 disables it")
+
+// markDownloaded records the zip at link of feed f as downloaded under
+// key, and when it was.
+func markDownloaded(c redis.Conn, f *Feed, key, link string) error {
+	if _, err := c.Do("HSET", f.key(downloadedQueue), key, link); err != nil {
+		return &StoreError{Op: "cannot set downloaded queue", Err: err}
+	}
+	if _, err := c.Do("ZADD", f.key(downloadedAtQueue), time.Now().Unix(), key); err != nil {
+		return &StoreError{Op: "cannot record download time", Err: err}
+	}
+	return nil
+}
+
+// needsRecheck reports whether the zip of feed f recorded under key was
+// downloaded within -recheck-since. Zips downloaded before their time was
+// recorded are never rechecked.
+func needsRecheck(c redis.Conn, f *Feed, key string) (bool, error) {
+	if *recheckSince <= 0 {
+		return false, nil
+	}
+	at, err := redis.Int64(c.Do("ZSCORE", f.key(downloadedAtQueue), key))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, &StoreError{Op: "cannot read download time", Err: err}
+	}
+	return time.Since(time.Unix(at, 0)) < *recheckSince, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// replayBatch is how many items of the source list are read at once.
+const replayBatch = 500
+
+var replayFrom = flag.String("replay-from", "", "push every item of this redis list to the configured sink again, through -transform, oldest first, and exit; the list is left as is and no feed is read")
+
+// replay pushes the items of the -replay-from list to the sink, oldest
+// first, assuming the list is fed with LPUSH as the output queue is by
+// default.
+func replay(pool *redis.Pool) error {
+	if *sinkType == sinkRedisList && *replayFrom == *outputQueue {
+		return errors.New("cannot replay -output-queue into itself")
+	}
+	c := pool.Get()
+	defer c.Close()
+	src := redisKey(*replayFrom)
+	length, err := redis.Int64(c.Do("LLEN", src))
+	if err != nil {
+		return &StoreError{Op: "cannot read replay list length", Err: err}
+	}
+	log.Printf("Replaying %d items of %s", length, src)
+	var pushed, skipped int64
+	for end := length - 1; end >= 0; end -= replayBatch {
+		start := end - replayBatch + 1
+		if start < 0 {
+			start = 0
+		}
+		items, err := redis.ByteSlices(c.Do("LRANGE", src, start, end))
+		if err != nil {
+			return &StoreError{Op: "cannot read replay list", Err: err}
+		}
+		for i := len(items) - 1; i >= 0; i-- {
+			name := fmt.Sprintf("%s-%d", *replayFrom, start+int64(i))
+			data, err := transformEntry(name, items[i])
+			if errors.Is(err, errTransformSkipped) {
+				log.Printf("Skipping item %s: %v", name, err)
+				skipped++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("cannot transform item %s: %v", name, err)
+			}
+			e := Entry{Zip: *replayFrom, Name: name, Data: data, RouteKey: routeKey(name, data)}
+			if err := output.Push(c, e); err != nil {
+				return &StoreError{Op: "cannot push replayed item", Err: err}
+			}
+			pushed++
+		}
+	}
+	log.Printf("Replayed %d items of %s, %d skipped", pushed, src, skipped)
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	stageDownload = "download"
+	stageExtract  = "extract"
+	stageStore    = "store"
+	stageOther    = "other"
+)
+
+// RunResult sums up what a run did, it is logged at the end of the run and
+// recorded in the runs hash.
+type RunResult struct {
+	ID     string    `json:"id"`
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+
+	LinksSeen       int64 `json:"links_seen"`
+	LinksClaimed    int64 `json:"links_claimed"`
+	LinksSkipped    int64 `json:"links_skipped"`
+	LinksDownloaded int64 `json:"links_downloaded"`
+	LinksRequeued   int64 `json:"links_requeued"`
+	LinksFailed     int64 `json:"links_failed"`
+
+	EntriesPushed  int64 `json:"entries_pushed"`
+	EntriesSkipped int64 `json:"entries_skipped"`
+	EntriesFailed  int64 `json:"entries_failed"`
+
+	// Errors counts the failures by the stage they happened in.
+	Errors map[string]int64 `json:"errors,omitempty"`
+	// Timings adds up the time spent in each step of processing links.
+	Timings map[string]StageTiming `json:"timings,omitempty"`
+}
+
+// StageTiming is the time spent in a step over a run.
+type StageTiming struct {
+	Count   int64 `json:"count"`
+	TotalMS int64 `json:"total_ms"`
+}
+
+// Duration returns how long the run took, or has taken so far.
+func (r RunResult) Duration() time.Duration {
+	if r.End.IsZero() {
+		return time.Since(r.Start)
+	}
+	return r.End.Sub(r.Start)
+}
+
+// log logs the counts of the run.
+func (r RunResult) log() {
+	log.Printf("Run %s %s after %v", r.ID, r.Status, r.Duration().Round(time.Second))
+	log.Printf("Zips: %d seen, %d claimed, %d skipped as processed, %d downloaded, %d left for a later run, %d failed",
+		r.LinksSeen, r.LinksClaimed, r.LinksSkipped, r.LinksDownloaded, r.LinksRequeued, r.LinksFailed)
+	log.Printf("Xmls: %d pushed, %d skipped, %d failed", r.EntriesPushed, r.EntriesSkipped, r.EntriesFailed)
+	var stages []string
+	for stage := range r.Errors {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		log.Printf("Errors while %s: %d", stage, r.Errors[stage])
+	}
+	var steps []string
+	for step := range r.Timings {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		t := r.Timings[step]
+		total := time.Duration(t.TotalMS) * time.Millisecond
+		log.Printf("Time in %s: %v over %d, %v each", step, total, t.Count, total/time.Duration(t.Count))
+	}
+}
+
+// runCounters are the counts of the current run not already kept by
+// runProgress or skippedZips, updated atomically by the workers.
+type runCounters struct {
+	claimed        int64
+	downloaded     int64
+	requeued       int64
+	failed         int64
+	entriesSkipped int64
+	entriesFailed  int64
+
+	mu      sync.Mutex
+	errors  map[string]int64
+	timings map[string]*stageTotal
+}
+
+// stageTotal adds up the time spent in a step.
+type stageTotal struct {
+	count int64
+	total time.Duration
+}
+
+var runStats = &runCounters{errors: map[string]int64{}}
+
+// reset zeroes the counts for a new run.
+func (s *runCounters) reset() {
+	for _, n := range []*int64{&s.claimed, &s.downloaded, &s.requeued, &s.failed, &s.entriesSkipped, &s.entriesFailed} {
+		atomic.StoreInt64(n, 0)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = map[string]int64{}
+	s.timings = nil
+}
+
+// errorSeen tallies err under the stage it comes from.
+func (s *runCounters) errorSeen(err error) {
+	stage := errorStage(err)
+	metrics.count("errors."+stage, 1)
+	s.mu.Lock()
+	s.errors[stage]++
+	s.mu.Unlock()
+}
+
+// timed adds d to the time spent in step, and sends it to statsd.
+func (s *runCounters) timed(step string, d time.Duration) {
+	metrics.timing("steps."+step, d)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timings == nil {
+		s.timings = map[string]*stageTotal{}
+	}
+	t := s.timings[step]
+	if t == nil {
+		t = &stageTotal{}
+		s.timings[step] = t
+	}
+	t.count++
+	t.total += d
+}
+
+// errorStage tells which stage of the pipeline err comes from.
+func errorStage(err error) string {
+	var (
+		downloadErr *DownloadError
+		hostErr     *HostError
+		archiveErr  *ArchiveError
+		storeErr    *StoreError
+	)
+	switch {
+	case errors.As(err, &storeErr):
+		return stageStore
+	case errors.As(err, &archiveErr):
+		return stageExtract
+	case errors.As(err, &downloadErr), errors.As(err, &hostErr):
+		return stageDownload
+	}
+	return stageOther
+}
+
+// result returns the RunResult of the run that started at start, err is
+// what it failed with, if anything.
+func (s *runCounters) result(start time.Time, err error) RunResult {
+	r := RunResult{
+		ID:              runID,
+		Status:          runOK,
+		Start:           start,
+		End:             time.Now(),
+		LinksSeen:       atomic.LoadInt64(&runProgress.found),
+		LinksClaimed:    atomic.LoadInt64(&s.claimed),
+		LinksSkipped:    int64(skippedZips.count()),
+		LinksDownloaded: atomic.LoadInt64(&s.downloaded),
+		LinksRequeued:   atomic.LoadInt64(&s.requeued),
+		LinksFailed:     atomic.LoadInt64(&s.failed),
+		EntriesPushed:   runProgress.pushedEntries(),
+		EntriesSkipped:  atomic.LoadInt64(&s.entriesSkipped),
+		EntriesFailed:   atomic.LoadInt64(&s.entriesFailed),
+		Errors:          map[string]int64{},
+	}
+	if err != nil {
+		r.Status = runFailed
+		r.Error = err.Error()
+	}
+	s.mu.Lock()
+	for stage, n := range s.errors {
+		r.Errors[stage] = n
+	}
+	if len(s.timings) > 0 {
+		r.Timings = map[string]StageTiming{}
+		for step, t := range s.timings {
+			r.Timings[step] = StageTiming{Count: t.count, TotalMS: t.total.Milliseconds()}
+		}
+	}
+	s.mu.Unlock()
+	return r
+}
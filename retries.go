@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+const (
+	retryBudgetFail = "fail"
+	retryBudgetSkip = "skip"
+)
+
+var (
+	maxTotalRetries   = flag.Int64("max-total-retries", 0, "retries of listing pages and zip downloads allowed across the whole run, 0 for no limit")
+	retryBudgetPolicy = flag.String("retry-budget-policy", retryBudgetFail, "what happens to a zip that fails once -max-total-retries is used up: fail the run, or skip the zip")
+)
+
+// errRetryBudgetExhausted is wrapped by the errors of fetches that were not
+// retried because the run used up -max-total-retries.
+var errRetryBudgetExhausted = errors.New("retry budget of the run exhausted")
+
+// retryBudget is how many retries the run may still make, shared by every
+// retry loop.
+type retryBudget struct {
+	used int64
+	// exhausted is set once running out was logged.
+	exhausted int32
+}
+
+var runRetries = &retryBudget{}
+
+// take reports whether one more retry fits in the budget, logging once
+// when it stops doing so.
+func (b *retryBudget) take() bool {
+	if *maxTotalRetries <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&b.used, 1) <= *maxTotalRetries {
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&b.exhausted, 0, 1) {
+		log.Printf("Used up the %d retries allowed by -max-total-retries, failures are not retried anymore", *maxTotalRetries)
+	}
+	return false
+}
+
+// reset gives the budget back for a new run.
+func (b *retryBudget) reset() {
+	atomic.StoreInt64(&b.used, 0)
+	atomic.StoreInt32(&b.exhausted, 0)
+}
+
+// outOfRetries wraps err, the failure that could not be retried.
+func outOfRetries(err error) error {
+	return fmt.Errorf("%w: %v", errRetryBudgetExhausted, err)
+}
+
+// checkRetryBudgetPolicy returns an error if -retry-budget-policy is not
+// a known policy.
+func checkRetryBudgetPolicy() error {
+	switch *retryBudgetPolicy {
+	case retryBudgetFail, retryBudgetSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown retry budget policy %q", *retryBudgetPolicy)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io"
+	"strings"
+)
+
+// maxRouteKeyLen bounds the routing key taken from an xml, longer values
+// are cut.
+const maxRouteKeyLen = 128
+
+var (
+	routeElement      = flag.String("route-element", "", "local name of the xml element whose text is the routing key of an entry, as with -route-element-queue, -shard-by=element and the route field of stream entries")
+	routeElementQueue = flag.Bool("route-element-queue", false, "push every xml to its queue with a :<routing key> suffix, xmls without the -route-element go to the queue itself")
+)
+
+// routeKey returns the text of the first -route-element of the xml in
+// data, empty if it has none or -route-element is not set. The xml is
+// only parsed up to that element.
+func routeKey(name string, data []byte) string {
+	if *routeElement == "" {
+		return ""
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				debugf("Cannot find routing key of xml %s: %v", name, err)
+			}
+			return ""
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != *routeElement {
+			continue
+		}
+		var text string
+		if err := dec.DecodeElement(&text, &start); err != nil {
+			debugf("Cannot read routing key of xml %s: %v", name, err)
+			return ""
+		}
+		text = strings.TrimSpace(text)
+		if len(text) > maxRouteKeyLen {
+			text = text[:maxRouteKeyLen]
+		}
+		return text
+	}
+}
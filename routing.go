@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	unknownTypeDefault = "default"
+	unknownTypeSkip    = "skip"
+)
+
+var (
+	typeQueuesFlag = flag.String("type-queues", "", "route entries to queues by type, as a comma separated list of extension=queue such as .xml=NEWS_XML,.json=NEWS_JSON; entries without a known extension are sniffed")
+	unknownType    = flag.String("unknown-type", unknownTypeDefault, "what to do with entries of a type -type-queues does not list: push them to the default queue, or skip them")
+)
+
+// typeQueues maps the entry types, as lowercase extensions, to the queues
+// they are pushed to; set up from -type-queues by parseTypeQueues.
+var typeQueues map[string]string
+
+// errUnroutable is wrapped by the error of entries skipped because their
+// type has no queue.
+var errUnroutable = errors.New("no queue for entry type")
+
+// parseTypeQueues sets typeQueues up from -type-queues.
+func parseTypeQueues() error {
+	switch *unknownType {
+	case unknownTypeDefault, unknownTypeSkip:
+	default:
+		return fmt.Errorf("unknown -unknown-type policy %q", *unknownType)
+	}
+	if *typeQueuesFlag == "" {
+		return nil
+	}
+	typeQueues = map[string]string{}
+	for _, pair := range strings.Split(*typeQueuesFlag, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") || parts[1] == "" {
+			return fmt.Errorf("invalid -type-queues entry %q, expected .ext=queue", pair)
+		}
+		typeQueues[strings.ToLower(parts[0])] = parts[1]
+	}
+	return nil
+}
+
+// entryType returns the type of the named entry, as a lowercase extension,
+// sniffing its contents when the name does not tell a known one.
+func entryType(name string, data []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if _, ok := typeQueues[ext]; ok {
+		return ext
+	}
+	head := bytes.TrimLeft(bytes.TrimPrefix(data, utf8BOM), " \t\r\n")
+	switch {
+	case bytes.HasPrefix(head, []byte("<")):
+		return ".xml"
+	case bytes.HasPrefix(head, []byte("{")), bytes.HasPrefix(head, []byte("[")):
+		return ".json"
+	}
+	return ext
+}
+
+// routeEntry returns the queue the named entry goes to by its type, empty
+// for the default queue.
+func routeEntry(name string, data []byte) (string, error) {
+	if typeQueues == nil {
+		return "", nil
+	}
+	typ := entryType(name, data)
+	if queue, ok := typeQueues[typ]; ok {
+		return queue, nil
+	}
+	if *unknownType == unknownTypeSkip {
+		return "", fmt.Errorf("%w %q", errUnroutable, typ)
+	}
+	return "", nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// runsHash records every run by id.
+	runsHash = "runs"
+
+	runRunning = "running"
+	runOK      = "ok"
+	runFailed  = "failed"
+
+	// releaseBatch is how many claims are dropped per DEL.
+	releaseBatch = 500
+)
+
+var (
+	runIDFlag = flag.String("run-id", "", "identifier of this run, prefixed to every log line and recorded in the runs hash; generated when empty")
+	claimTTL  = flag.Duration("claim-ttl", 24*time.Hour, "how long the claims a run takes on links last if the run dies before releasing them")
+)
+
+// runID identifies the current run, set up by setupRunID.
+var runID string
+
+// liveRunID holds runID for the goroutines that outlive a run, like the
+// heartbeat.
+var liveRunID atomic.Value
+
+// runStart is when the current run started.
+var runStart = time.Now()
+
+// linkClaims tracks the claims the run took on links, so a link listed
+// twice is only processed once even before it is recorded as downloaded.
+type linkClaims struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+var runClaims = &linkClaims{}
+
+// claim reports whether the run took link of feed f for itself, false
+// means another worker of the run already did.
+func (l *linkClaims) claim(c redis.Conn, f *Feed, link string) (bool, error) {
+	key := f.key("run:" + runID + ":claim:" + link)
+	reply, err := c.Do("SET", key, 1, "NX", "PX", claimTTL.Milliseconds())
+	if err != nil {
+		return false, &StoreError{Op: "cannot claim link", Err: err}
+	}
+	if reply == nil {
+		return false, nil
+	}
+	atomic.AddInt64(&runStats.claimed, 1)
+	l.mu.Lock()
+	l.keys = append(l.keys, key)
+	l.mu.Unlock()
+	return true, nil
+}
+
+// reset forgets the claims of the last run, they were released already.
+func (l *linkClaims) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys = nil
+}
+
+// release drops every claim taken by the run.
+func (l *linkClaims) release(c redis.Conn) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.keys) > 0 {
+		n := len(l.keys)
+		if n > releaseBatch {
+			n = releaseBatch
+		}
+		if _, err := c.Do("DEL", redis.Args{}.AddFlat(l.keys[:n])...); err != nil {
+			return &StoreError{Op: "cannot release link claims", Err: err}
+		}
+		l.keys = l.keys[n:]
+	}
+	return nil
+}
+
+// setupRunID sets runID from -run-id or generates one out of the start
+// time and some random bytes, and prefixes log lines with it. Passes after
+// the first of a -poll run get the pass number appended to -run-id.
+func setupRunID(pass int) error {
+	runID = *runIDFlag
+	if runID != "" && pass > 1 {
+		runID = fmt.Sprintf("%s-%d", runID, pass)
+	}
+	if runID == "" {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("cannot generate run id: %v", err)
+		}
+		runID = runStart.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+	}
+	liveRunID.Store(runID)
+	log.SetPrefix("run=" + runID + " ")
+	return nil
+}
+
+// startRun records the run as running.
+func startRun(c redis.Conn) error {
+	return saveRun(c, RunResult{ID: runID, Status: runRunning, Start: runStart})
+}
+
+// finishRun records the outcome and the counts of the run and returns
+// them, err is what the crawl failed with, if anything.
+func finishRun(c redis.Conn, err error) (RunResult, error) {
+	result := runStats.result(runStart, err)
+	return result, saveRun(c, result)
+}
+
+func saveRun(c redis.Conn, result RunResult) error {
+	record, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Do("HSET", redisKey(runsHash), runID, record); err != nil {
+		return &StoreError{Op: "cannot record run", Err: err}
+	}
+	return nil
+}
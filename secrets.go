@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var (
+	redisPasswordFile   = flag.String("redis-password-file", "", "file holding the redis AUTH password, which then stays off the command line")
+	feedHeadersFile     = flag.String("feed-headers-file", "", "file of Name: value lines, such as api keys, added to every request to the hosts of the feeds")
+	httpSinkHeadersFile = flag.String("http-sink-headers-file", "", "file of Name: value lines added to every POST of -sink=http")
+	tlsClientCert       = flag.String("tls-client-cert", "", "pem certificate presented to servers that ask for one, its key is read from -tls-client-key-file")
+	tlsClientKeyFile    = flag.String("tls-client-key-file", "", "pem key of -tls-client-cert")
+)
+
+// the values read from the secrets files, never logged.
+var (
+	redisPassword   string
+	feedHeaders     http.Header
+	httpSinkHeaders http.Header
+	clientCert      *tls.Certificate
+)
+
+// loadSecrets reads the secrets files given by the flags. Secrets files
+// must not be readable or writable by others.
+func loadSecrets() error {
+	if *redisPasswordFile != "" {
+		if strings.Contains(*redisAddr, "@") {
+			return errors.New("-redis-password-file cannot be used with a password in -redis")
+		}
+		data, err := readSecretFile(*redisPasswordFile)
+		if err != nil {
+			return err
+		}
+		redisPassword = strings.TrimRight(string(data), "\r\n")
+		if redisPassword == "" {
+			return fmt.Errorf("redis password file %s is empty", *redisPasswordFile)
+		}
+	}
+	var err error
+	if feedHeaders, err = readHeadersFile(*feedHeadersFile); err != nil {
+		return err
+	}
+	if httpSinkHeaders, err = readHeadersFile(*httpSinkHeadersFile); err != nil {
+		return err
+	}
+	if (*tlsClientCert == "") != (*tlsClientKeyFile == "") {
+		return errors.New("-tls-client-cert and -tls-client-key-file go together")
+	}
+	if *tlsClientKeyFile != "" {
+		key, err := readSecretFile(*tlsClientKeyFile)
+		if err != nil {
+			return err
+		}
+		certPEM, err := os.ReadFile(*tlsClientCert)
+		if err != nil {
+			return fmt.Errorf("cannot read client certificate: %v", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, key)
+		if err != nil {
+			// the error of X509KeyPair does not quote the key.
+			return fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		clientCert = &cert
+	}
+	return nil
+}
+
+// readSecretFile returns the contents of the secrets file at path, unless
+// others than its owner and group may read or write it.
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read secrets file: %v", err)
+	}
+	// windows does not keep unix permissions, they read as 0666.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o006 != 0 {
+		return nil, fmt.Errorf("secrets file %s has mode %v and can be read or written by anyone, remove the permissions of others with chmod o-rwx", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read secrets file: %v", err)
+	}
+	return data, nil
+}
+
+// readHeadersFile returns the headers in the secrets file at path, none
+// if path is empty. Errors only tell the line, not its contents.
+func readHeadersFile(path string) (http.Header, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := readSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d of headers file %s is not Name: value", n, path)
+		}
+		header.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i])), strings.TrimSpace(line[i+1:]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read headers file %s: %v", path, err)
+	}
+	return header, nil
+}
+
+// headerTransport adds the -feed-headers-file headers to the requests to
+// the feed hosts, so they are not sent wherever zips redirect to.
+type headerTransport struct {
+	base   http.RoundTripper
+	hosts  map[string]bool
+	header http.Header
+}
+
+func (h *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !h.hosts[strings.ToLower(req.URL.Hostname())] {
+		return h.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, values := range h.header {
+		req.Header[name] = values
+	}
+	return h.base.RoundTrip(req)
+}
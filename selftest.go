@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const selftestEntry = "selftest.xml"
+
+// selftest serves a generated zip from a local http server, runs it
+// through the same download, extract and push path as the feed zips and
+// checks its xml landed in redis. Everything it writes to redis is removed
+// before returning.
+func selftest(pool *redis.Pool, cache *archiveCache) error {
+	nonce := time.Now().UnixNano()
+	xml := fmt.Sprintf("<selftest>%d</selftest>", nonce)
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create(selftestEntry)
+	if err != nil {
+		return fmt.Errorf("cannot create selftest zip: %v", err)
+	}
+	if _, err := f.Write([]byte(xml)); err != nil {
+		return fmt.Errorf("cannot create selftest zip: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("cannot create selftest zip: %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	link := fmt.Sprintf("%s/selftest-%d%s", srv.URL, nonce, zipSuffix)
+
+	defer isolateSelftest(nonce)()
+
+	c := pool.Get()
+	defer c.Close()
+	defer func() {
+		c.Do("DEL", redisKey(*outputQueue))
+		c.Do("HDEL", redisKey(downloadedQueue), link)
+		c.Do("ZREM", redisKey(downloadedAtQueue), link)
+		c.Do("HDEL", redisKey(processedQueue), entryKey(link, selftestEntry))
+		runClaims.release(c)
+	}()
+
+	log.Printf("Running selftest with %s", link)
+	if _, err := processLink(context.Background(), Link{URL: link, Feed: &Feed{URL: srv.URL, Type: feedTypeHTML}}, c, cache); err != nil {
+		return err
+	}
+	got, err := redis.String(c.Do("LINDEX", redisKey(*outputQueue), 0))
+	if err == redis.ErrNil {
+		return fmt.Errorf("xml was not pushed to redis")
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read pushed xml: %v", err)
+	}
+	if got != xml {
+		return fmt.Errorf("pushed xml is %q, expected %q", got, xml)
+	}
+	for _, check := range []struct{ key, field string }{
+		{downloadedQueue, link},
+		{processedQueue, entryKey(link, selftestEntry)},
+	} {
+		ok, err := hashHas(c, redisKey(check.key), check.field)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", check.key, err)
+		}
+		if !ok {
+			return fmt.Errorf("%s was not recorded in %s", check.field, check.key)
+		}
+	}
+	return nil
+}
+
+// isolateSelftest sets up the selftest to push to a queue of its own, so
+// the xml does not reach the real consumers, and to download its zip from
+// the local server whatever -allow-host, -deny-host, -local-dir,
+// -verify-checksums and -entry-pattern say. It returns the function
+// putting the settings back.
+func isolateSelftest(nonce int64) (restore func()) {
+	queue, n, sink := *outputQueue, *shards, output
+	allow, deny, dir := allowHosts, denyHosts, *localDir
+	verify, filter := *verifyChecksums, entryFilter
+	*outputQueue, *shards, output = fmt.Sprintf("selftest:%d", nonce), 1, listSink{}
+	allowHosts, denyHosts, *localDir = nil, nil, ""
+	*verifyChecksums, entryFilter = false, nil
+	return func() {
+		*outputQueue, *shards, output = queue, n, sink
+		allowHosts, denyHosts, *localDir = allow, deny, dir
+		*verifyChecksums, entryFilter = verify, filter
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals makes SIGUSR1 toggle the pause of the crawl and
+// SIGUSR2 resume it.
+func handlePauseSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				workPause.toggle()
+			} else {
+				workPause.set(false)
+			}
+		}
+	}()
+}
+
+// handleReloadSignal makes SIGHUP reload -config.
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadConfig()
+		}
+	}()
+}
@@ -0,0 +1,7 @@
+package main
+
+// handlePauseSignals does nothing, there are no user signals on windows.
+func handlePauseSignals() {}
+
+// handleReloadSignal does nothing, there is no SIGHUP on windows.
+func handleReloadSignal() {}
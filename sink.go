@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	sinkRedisList   = "redis-list"
+	sinkRedisStream = "redis-stream"
+
+	pushLeft  = "lpush"
+	pushRight = "rpush"
+
+	shardByName    = "name"
+	shardByContent = "content"
+	shardByElement = "element"
+)
+
+var (
+	sinkType       = flag.String("sink", sinkRedisList, "where extracted xmls are pushed: redis-list (LPUSH to -output-queue), redis-stream (XADD to -stream-key), http (POST to -http-sink-url), s3 when built with the s3 tag, or kafka when built with the kafka tag")
+	outputPush     = flag.String("output-push", pushLeft, "how xmls are added to the list with -sink=redis-list: lpush, newest at the head, or rpush, newest at the tail")
+	outputMaxLen   = flag.Int("output-maxlen", 0, "trim the list to its newest this many xmls after every push with -sink=redis-list; the oldest xmls are DROPPED whether consumers read them or not, only for consumers that want the latest. 0 for no trimming")
+	streamKey      = flag.String("stream-key", "NEWS_XML_STREAM", "redis stream extracted xmls are added to with -sink=redis-stream")
+	streamMaxLen   = flag.Int("stream-maxlen", 0, "approximate maximum length the stream is trimmed to on every add, 0 for no trimming")
+	streamMetadata = flag.Bool("stream-metadata", true, "add the zip and entry names as fields next to the xml in stream entries")
+
+	shards  = flag.Int("shards", 1, "spread extracted xmls over this many redis lists or streams, named after -output-queue or -stream-key with a :<shard> suffix")
+	shardBy = flag.String("shard-by", shardByName, "what picks the shard of an xml: name, its zip and entry names; content; or element, its -route-element, falling back to name")
+)
+
+// Entry is an extracted archive entry.
+type Entry struct {
+	// Zip is the link of the archive.
+	Zip string
+	// Name is the name of the entry within the archive.
+	Name string
+	Data []byte
+	// Feed is the feed the archive was listed in, nil for the default one.
+	Feed *Feed
+	// Queue is the queue the entry was routed to by its type, empty for
+	// the queue of its feed.
+	Queue string
+	// RouteKey is the text of the -route-element of the entry, if any.
+	RouteKey string
+}
+
+// queue returns the queue e goes to: the one routed by its type, or the
+// queue of its feed, def if none; suffixed with its routing key with
+// -route-element-queue.
+func (e Entry) queue(def string) string {
+	q := e.Queue
+	if q == "" {
+		q = e.Feed.queue(def)
+	}
+	if *routeElementQueue && e.RouteKey != "" {
+		q += ":" + e.RouteKey
+	}
+	return q
+}
+
+// Sink is where extracted entries are delivered to. Sinks receive the
+// calling worker's redis connection, which they may ignore.
+type Sink interface {
+	Push(c redis.Conn, e Entry) error
+}
+
+// deduper is implemented by sinks that can tell by themselves whether an
+// entry was already delivered, they are asked instead of the processed
+// entries hash.
+type deduper interface {
+	Delivered(e Entry) (bool, error)
+}
+
+// output is the Sink every entry is pushed to, set up from -sink, unless
+// the crawl carries one of its own.
+var output Sink = listSink{}
+
+type sinkKey struct{}
+
+// withSink returns ctx carrying the sink the entries extracted in it are
+// pushed to instead of output.
+func withSink(ctx context.Context, s Sink) context.Context {
+	return context.WithValue(ctx, sinkKey{}, s)
+}
+
+// sinkOf returns the sink carried by ctx, output if none.
+func sinkOf(ctx context.Context) Sink {
+	if s, ok := ctx.Value(sinkKey{}).(Sink); ok {
+		return s
+	}
+	return output
+}
+
+// sinks maps the -sink names to their constructors, sinks with heavy
+// dependencies register themselves from files behind build tags.
+var sinks = map[string]func() (Sink, error){
+	sinkRedisList:   func() (Sink, error) { return listSink{}, nil },
+	sinkRedisStream: func() (Sink, error) { return streamSink{}, nil },
+}
+
+// newSink returns the Sink selected by -sink.
+func newSink() (Sink, error) {
+	newFunc, ok := sinks[*sinkType]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %q, this build supports %s", *sinkType, strings.Join(sinkNames(), ", "))
+	}
+	return newFunc()
+}
+
+// sinkNames returns the sorted names of the available sinks.
+func sinkNames() []string {
+	var names []string
+	for name := range sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkShards returns an error if the -shards settings are invalid.
+func checkShards() error {
+	if *shards < 1 {
+		return fmt.Errorf("-shards must be at least 1")
+	}
+	switch *shardBy {
+	case shardByName, shardByContent:
+		return nil
+	case shardByElement:
+		if *routeElement == "" {
+			return fmt.Errorf("-shard-by=element needs -route-element")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown shard key %q", *shardBy)
+}
+
+// checkOutputList returns an error if the -sink=redis-list settings are
+// invalid.
+func checkOutputList() error {
+	if *outputPush != pushLeft && *outputPush != pushRight {
+		return fmt.Errorf("unknown -output-push %q", *outputPush)
+	}
+	if *outputMaxLen < 0 {
+		return fmt.Errorf("-output-maxlen cannot be negative")
+	}
+	return nil
+}
+
+// shardKey returns the redis key of the shard of base e goes to, base
+// itself when not sharding, in the namespace of the feed of e.
+func shardKey(base string, e Entry) string {
+	if *shards <= 1 {
+		return e.Feed.key(base)
+	}
+	h := fnv.New32a()
+	switch {
+	case *shardBy == shardByContent:
+		h.Write(e.Data)
+	case *shardBy == shardByElement && e.RouteKey != "":
+		h.Write([]byte(e.RouteKey))
+	default:
+		h.Write([]byte(e.Zip + "/" + e.Name))
+	}
+	return shardName(e.Feed, base, int(h.Sum32()%uint32(*shards)))
+}
+
+// shardName returns the redis key of the given shard of base in feed f.
+func shardName(f *Feed, base string, shard int) string {
+	return f.key(base + ":" + strconv.Itoa(shard))
+}
+
+// shardNames returns the redis keys of every shard of base in feed f.
+func shardNames(f *Feed, base string) []string {
+	if *shards <= 1 {
+		return []string{f.key(base)}
+	}
+	names := make([]string, *shards)
+	for i := range names {
+		names[i] = shardName(f, base, i)
+	}
+	return names
+}
+
+// listSink pushes entries to the -output-queue list, at the end given by
+// -output-push, trimming it to -output-maxlen.
+type listSink struct{}
+
+func (listSink) Push(c redis.Conn, e Entry) error {
+	key := shardKey(e.queue(*outputQueue), e)
+	cmd := "LPUSH"
+	if *outputPush == pushRight {
+		cmd = "RPUSH"
+	}
+	if _, err := c.Do(cmd, key, e.Data); err != nil {
+		return err
+	}
+	if *outputMaxLen <= 0 {
+		return nil
+	}
+	// keep the newest end of the list, the one pushed to.
+	start, stop := 0, *outputMaxLen-1
+	if *outputPush == pushRight {
+		start, stop = -*outputMaxLen, -1
+	}
+	_, err := c.Do("LTRIM", key, start, stop)
+	return err
+}
+
+// streamSink adds entries to the -stream-key stream so consumers can use
+// consumer groups.
+type streamSink struct{}
+
+func (streamSink) Push(c redis.Conn, e Entry) error {
+	args := redis.Args{shardKey(e.queue(*streamKey), e)}
+	if *streamMaxLen > 0 {
+		args = args.Add("MAXLEN", "~", *streamMaxLen)
+	}
+	args = args.Add("*", "xml", e.Data)
+	if *streamMetadata {
+		args = args.Add("zip", e.Zip, "entry", e.Name)
+		if e.RouteKey != "" {
+			args = args.Add("route", e.RouteKey)
+		}
+	}
+	_, err := c.Do("XADD", args...)
+	return err
+}
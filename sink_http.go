@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	sinkHTTP = "http"
+
+	httpSinkRaw  = "raw"
+	httpSinkJSON = "json"
+)
+
+var (
+	httpSinkURL         = flag.String("http-sink-url", "", "url every extracted xml is POSTed to with -sink=http")
+	httpSinkFormat      = flag.String("http-sink-format", httpSinkRaw, `body of the POSTs: raw, the xml with the zip and entry names as X-Zip and X-Entry headers; or json, {"zip": "...", "entry": "...", "route": "...", "xml": "..."}`)
+	httpSinkConcurrency = flag.Int("http-sink-concurrency", 4, "POSTs in flight at once across the workers")
+	httpSinkRetries     = flag.Int("http-sink-retries", 5, "times a POST is retried when the endpoint cannot be reached or answers 429 or 5xx")
+	httpSinkBackoff     = flag.Duration("http-sink-backoff", time.Second, "wait before the first POST retry, doubled on every further one")
+	httpSinkTimeout     = flag.Duration("http-sink-timeout", 30*time.Second, "time a single POST may take")
+	httpSinkDedupHeader = flag.String("http-sink-dedup-header", "Idempotency-Key", "header carrying a key unique to the zip and entry, so the endpoint can drop repeats itself; empty for none. Pushed xmls are still recorded in redis")
+)
+
+func init() {
+	sinks[sinkHTTP] = newHTTPSink
+}
+
+// httpSink POSTs every entry to an http endpoint.
+type httpSink struct {
+	client *http.Client
+	url    string
+	slots  chan struct{}
+}
+
+// httpEnvelope is the body of the POSTs with -http-sink-format=json.
+type httpEnvelope struct {
+	Zip   string `json:"zip"`
+	Entry string `json:"entry"`
+	Route string `json:"route,omitempty"`
+	XML   string `json:"xml"`
+}
+
+func newHTTPSink() (Sink, error) {
+	if *httpSinkURL == "" {
+		return nil, fmt.Errorf("-http-sink-url is required with -sink=http")
+	}
+	u, err := url.Parse(*httpSinkURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("-http-sink-url must be an http or https url")
+	}
+	switch *httpSinkFormat {
+	case httpSinkRaw, httpSinkJSON:
+	default:
+		return nil, fmt.Errorf("unknown -http-sink-format %q", *httpSinkFormat)
+	}
+	if *httpSinkConcurrency < 1 {
+		return nil, fmt.Errorf("-http-sink-concurrency must be at least 1")
+	}
+	return &httpSink{
+		client: &http.Client{Timeout: *httpSinkTimeout},
+		url:    *httpSinkURL,
+		slots:  make(chan struct{}, *httpSinkConcurrency),
+	}, nil
+}
+
+func (s *httpSink) Push(_ redis.Conn, e Entry) error {
+	body, contentType := e.Data, "application/xml"
+	if *httpSinkFormat == httpSinkJSON {
+		var err error
+		body, err = json.Marshal(httpEnvelope{Zip: e.Zip, Entry: e.Name, Route: e.RouteKey, XML: string(e.Data)})
+		if err != nil {
+			return fmt.Errorf("cannot encode entry: %v", err)
+		}
+		contentType = "application/json"
+	}
+	return s.send(e, bytes.NewReader(body), int64(len(body)), contentType)
+}
+
+// PushFrom streams raw bodies from r, json envelopes need the xml read
+// into memory.
+func (s *httpSink) PushFrom(c redis.Conn, e Entry, r io.ReadSeeker, size int64) error {
+	if *httpSinkFormat == httpSinkJSON {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		e.Data = data
+		return s.Push(c, e)
+	}
+	return s.send(e, r, size, "application/xml")
+}
+
+// send POSTs body, of the given size, as e, retrying on transient
+// failures.
+func (s *httpSink) send(e Entry, body io.ReadSeeker, size int64, contentType string) error {
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+	for attempt := 0; ; attempt++ {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		err := s.post(e, body, size, contentType)
+		if err == nil {
+			return nil
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && !retryableSinkStatus(statusErr.Code) {
+			return err
+		}
+		if attempt >= *httpSinkRetries {
+			return err
+		}
+		wait := backoff(*httpSinkBackoff, attempt)
+		log.Printf("Cannot POST %s/%s, retrying in %v: %v", e.Zip, e.Name, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// post makes a single POST of e, as body of the given size.
+func (s *httpSink) post(e Entry, body io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequest("POST", s.url, ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	for name, values := range httpSinkHeaders {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if *httpSinkFormat == httpSinkRaw {
+		req.Header.Set("X-Zip", e.Zip)
+		req.Header.Set("X-Entry", e.Name)
+	}
+	if *httpSinkDedupHeader != "" {
+		sum := sha256.Sum256([]byte(e.Zip + "/" + e.Name))
+		req.Header.Set(*httpSinkDedupHeader, hex.EncodeToString(sum[:]))
+	}
+	response, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(response.Body)
+	if response.StatusCode/100 != 2 {
+		return &StatusError{Code: response.StatusCode, Status: response.Status}
+	}
+	return nil
+}
+
+// retryableSinkStatus reports whether a POST answered with code is worth
+// retrying.
+func retryableSinkStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
@@ -0,0 +1,93 @@
+//go:build kafka
+// +build kafka
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	sinkKafka = "kafka"
+
+	// kafkaBatchTimeout is how long produced messages wait for others to
+	// share their batch. Pushes write one message and wait for it, so it
+	// bounds the time every push takes.
+	kafkaBatchTimeout = 5 * time.Millisecond
+)
+
+var (
+	kafkaBrokers  = flag.String("kafka-brokers", "localhost:9092", "comma separated host:port of the kafka brokers used with -sink=kafka")
+	kafkaTopic    = flag.String("kafka-topic", "", "topic extracted xmls are produced to with -sink=kafka; xmls of feeds with an output_queue, or routed by -type-queues, are produced to the topic of that name instead")
+	kafkaKey      = flag.Bool("kafka-key", true, "use the entry name as the message key, so entries of the same name land in the same partition")
+	kafkaMetadata = flag.Bool("kafka-metadata", true, "add the zip and entry names as headers of every message")
+	kafkaAcks     = flag.Int("kafka-acks", -1, "acknowledgements required per message: -1 all in-sync replicas, 1 the leader only, 0 none")
+)
+
+func init() {
+	sinks[sinkKafka] = newKafkaSink
+}
+
+// kafkaSink produces every entry as a message of the kafka topic named as
+// its queue.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func newKafkaSink() (Sink, error) {
+	if *kafkaTopic == "" {
+		return nil, fmt.Errorf("-kafka-topic is required with -sink=kafka")
+	}
+	var brokers []string
+	for _, b := range strings.Split(*kafkaBrokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("-kafka-brokers is required with -sink=kafka")
+	}
+	switch *kafkaAcks {
+	case -1, 0, 1:
+	default:
+		return nil, fmt.Errorf("-kafka-acks must be -1, 0 or 1")
+	}
+	// kafka spreads a topic over partitions by key instead.
+	if *shards > 1 {
+		return nil, fmt.Errorf("-shards cannot be used with -sink=kafka, use -kafka-key to spread xmls over partitions")
+	}
+	if *routeElementQueue {
+		return nil, fmt.Errorf("-route-element-queue cannot be used with -sink=kafka")
+	}
+	// the topic is set per message, as the queue of each entry.
+	return &kafkaSink{w: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequiredAcks(*kafkaAcks),
+		BatchTimeout: kafkaBatchTimeout,
+	}}, nil
+}
+
+func (s *kafkaSink) Push(_ redis.Conn, e Entry) error {
+	msg := kafka.Message{Topic: e.queue(*kafkaTopic), Value: e.Data}
+	if *kafkaKey {
+		msg.Key = []byte(e.Name)
+	}
+	if *kafkaMetadata {
+		msg.Headers = []kafka.Header{
+			{Key: "zip", Value: []byte(e.Zip)},
+			{Key: "entry", Value: []byte(e.Name)},
+		}
+	}
+	if err := s.w.WriteMessages(context.Background(), msg); err != nil {
+		return fmt.Errorf("cannot produce to kafka: %v", err)
+	}
+	return nil
+}
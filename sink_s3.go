@@ -0,0 +1,94 @@
+//go:build s3
+// +build s3
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const sinkS3 = "s3"
+
+var (
+	s3Endpoint  = flag.String("s3-endpoint", "s3.amazonaws.com", "host[:port] of the S3 compatible service, e.g. a MinIO server")
+	s3Insecure  = flag.Bool("s3-insecure", false, "talk to -s3-endpoint over plain http")
+	s3Region    = flag.String("s3-region", "", "region of the bucket, found out automatically when empty")
+	s3Bucket    = flag.String("s3-bucket", "", "bucket extracted xmls are written to with -sink=s3")
+	s3Prefix    = flag.String("s3-prefix", "", "prefix of the object keys, which are <prefix>/<zip>/<entry>")
+	s3AccessKey = flag.String("s3-access-key", "", "S3 access key, AWS_ACCESS_KEY_ID is used when empty")
+	s3SecretKey = flag.String("s3-secret-key", "", "S3 secret key, AWS_SECRET_ACCESS_KEY is used when empty")
+)
+
+func init() {
+	sinks[sinkS3] = newS3Sink
+}
+
+// s3Sink writes every entry as an object of an S3 compatible bucket, an
+// entry is considered delivered once its object exists.
+type s3Sink struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Sink() (Sink, error) {
+	if *s3Bucket == "" {
+		return nil, fmt.Errorf("-s3-bucket is required with -sink=s3")
+	}
+	creds := credentials.NewEnvAWS()
+	if *s3AccessKey != "" {
+		creds = credentials.NewStaticV4(*s3AccessKey, *s3SecretKey, "")
+	}
+	client, err := minio.New(*s3Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !*s3Insecure,
+		Region: *s3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create S3 client: %v", err)
+	}
+	return &s3Sink{client: client, bucket: *s3Bucket}, nil
+}
+
+// objectKey returns the key of the object e is stored as.
+func (s *s3Sink) objectKey(e Entry) string {
+	zipName := e.Zip
+	for _, scheme := range []string{"http://", "https://"} {
+		zipName = strings.TrimPrefix(zipName, scheme)
+	}
+	return path.Join(*s3Prefix, zipName, e.Name)
+}
+
+func (s *s3Sink) Push(_ redis.Conn, e Entry) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectKey(e),
+		bytes.NewReader(e.Data), int64(len(e.Data)),
+		minio.PutObjectOptions{ContentType: "application/xml"})
+	return err
+}
+
+func (s *s3Sink) PushFrom(_ redis.Conn, e Entry, r io.ReadSeeker, size int64) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectKey(e), r, size,
+		minio.PutObjectOptions{ContentType: "application/xml"})
+	return err
+}
+
+func (s *s3Sink) Delivered(e Entry) (bool, error) {
+	_, err := s.client.StatObject(context.Background(), s.bucket, s.objectKey(e), minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
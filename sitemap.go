@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+)
+
+var (
+	sitemapMaxDepth = flag.Int("sitemap-max-depth", 3, "how deep sitemap indexes pointing to further sitemaps are followed with -feed-type=sitemap")
+	sitemapMaxFiles = flag.Int("sitemap-max-files", 1000, "maximum sitemaps read per feed with -feed-type=sitemap, indexes included")
+)
+
+// sitemapLoc is a <url> of a sitemap or a <sitemap> of a sitemap index.
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemapReader reads a sitemap, following the sitemaps listed in indexes
+// within -sitemap-max-depth and -sitemap-max-files.
+type sitemapReader struct {
+	ctx   context.Context
+	links chan string
+	seen  map[string]bool
+}
+
+// downloadSitemapLinks reads the sitemap, or sitemap index, at sitemapURL
+// and feeds the archive urls in it to links, which is closed once done.
+func downloadSitemapLinks(ctx context.Context, sitemapURL string, links chan string, fail chan error) {
+	defer close(links)
+	r := &sitemapReader{ctx: ctx, links: links, seen: map[string]bool{}}
+	if err := r.read(sitemapURL, 0); err != nil && ctx.Err() == nil {
+		fail <- err
+	}
+}
+
+// read feeds the archive urls of the sitemap at sitemapURL, found depth
+// indexes down from the feed, to the links.
+func (r *sitemapReader) read(sitemapURL string, depth int) error {
+	if r.seen[sitemapURL] {
+		log.Printf("Sitemap %s was already read, skipping it", sitemapURL)
+		return nil
+	}
+	if len(r.seen) >= *sitemapMaxFiles {
+		log.Printf("Read %d sitemaps, not reading %s, see -sitemap-max-files", len(r.seen), sitemapURL)
+		return nil
+	}
+	r.seen[sitemapURL] = true
+	children, err := r.readFile(sitemapURL)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 && depth >= *sitemapMaxDepth {
+		log.Printf("Sitemap index %s is %d levels deep, not following its %d sitemaps, see -sitemap-max-depth", sitemapURL, depth, len(children))
+		return nil
+	}
+	for _, child := range children {
+		if err := r.read(child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFile feeds the archive urls in the sitemap at sitemapURL to the
+// links and returns the sitemaps it lists, if it is an index. Gzipped
+// sitemaps are decompressed as they stream.
+func (r *sitemapReader) readFile(sitemapURL string) ([]string, error) {
+	response, err := fetchListing(r.ctx, sitemapURL)
+	if err != nil {
+		return nil, &DownloadError{Link: sitemapURL, Op: "cannot get sitemap", Err: err}
+	}
+	defer closeBody(response.Body)
+
+	parseErr := func(err error) error {
+		return &DownloadError{Link: sitemapURL, Op: "cannot parse sitemap", Err: err}
+	}
+	base, err := url.Parse(sitemapURL)
+	if err != nil {
+		return nil, parseErr(err)
+	}
+	var body io.Reader = response.Body
+	if strings.HasSuffix(base.Path, ".gz") {
+		gz, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return nil, parseErr(err)
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// resolve returns the loc as an absolute url, sitemaps should only
+	// hold those but relative ones are common enough.
+	resolve := func(ref string) (string, error) {
+		u, err := url.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return "", fmt.Errorf("invalid url %q: %v", ref, err)
+		}
+		return base.ResolveReference(u).String(), nil
+	}
+	var children []string
+	dec := xml.NewDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return children, nil
+		}
+		if err != nil {
+			return nil, parseErr(err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+		var loc sitemapLoc
+		if err := dec.DecodeElement(&loc, &start); err != nil {
+			return nil, parseErr(err)
+		}
+		if loc.Loc == "" {
+			continue
+		}
+		link, err := resolve(loc.Loc)
+		if err != nil {
+			return nil, parseErr(err)
+		}
+		if start.Name.Local == "sitemap" {
+			children = append(children, link)
+			continue
+		}
+		if !hasArchiveExt(link) {
+			continue
+		}
+		if !emitLink(r.ctx, r.links, link) {
+			return nil, r.ctx.Err()
+		}
+	}
+}
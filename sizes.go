@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// sizeSkippedQueue records links skipped for their size, with the size.
+const sizeSkippedQueue = "size-skipped"
+
+var (
+	minArchiveBytes = flag.Int64("min-archive-bytes", 0, "skip zips smaller than this, told by Content-Length before downloading and checked again after; 0 for no limit")
+	maxArchiveBytes = flag.Int64("max-archive-bytes", 0, "skip zips larger than this, told by Content-Length before downloading and checked again after; 0 for no limit")
+)
+
+// SizeError is returned for archives whose size is out of the range set by
+// -min-archive-bytes and -max-archive-bytes.
+type SizeError struct {
+	Size int64
+	// Limit is the bound the size crossed, Over tells whether it is the
+	// maximum.
+	Limit int64
+	Over  bool
+}
+
+func (e *SizeError) Error() string {
+	if e.Over {
+		return fmt.Sprintf("%d bytes, over the maximum of %d", e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%d bytes, under the minimum of %d", e.Size, e.Limit)
+}
+
+// checkArchiveSize returns a *SizeError if an archive of size bytes must
+// be skipped.
+func checkArchiveSize(size int64) error {
+	if size < *minArchiveBytes {
+		return &SizeError{Size: size, Limit: *minArchiveBytes}
+	}
+	if *maxArchiveBytes > 0 && size > *maxArchiveBytes {
+		return &SizeError{Size: size, Limit: *maxArchiveBytes, Over: true}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+)
+
+var snapshot = flag.Bool("snapshot", false, "read the whole listing of every feed before processing any of its zips, so a pass works on the zips listed when it started; costs the time to read the listing before the first download, and holds the links in memory")
+
+// snapshotLinks reads every link of feed f from feedLinks and returns a
+// channel replaying them. If ctx is done first the links read so far are
+// dropped and the channel is empty.
+func snapshotLinks(ctx context.Context, f *Feed, feedLinks chan string) chan string {
+	var listed []string
+	for link := range feedLinks {
+		listed = append(listed, link)
+	}
+	replay := make(chan string, len(listed))
+	if ctx.Err() == nil {
+		log.Printf("Listed %d zips of feed %s, processing them", len(listed), f.URL)
+		for _, link := range listed {
+			replay <- link
+		}
+	}
+	close(replay)
+	return replay
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// spoolSuffix ends the names of downloads spooled gzipped to disk.
+const spoolSuffix = ".spool.gz"
+
+var spoolCompress = flag.Bool("spool-compress", false, "gzip downloads while writing them to the temp dir and decompress them when read, trading cpu for disk; zips need random access and are decompressed to a second temp file while open, and this is no gain for zips whose entries are already compressed")
+
+// checkSpoolCompress returns an error if -spool-compress is combined with
+// flags it does not work with.
+func checkSpoolCompress() error {
+	if *spoolCompress && *cacheDir != "" {
+		return errors.New("-spool-compress cannot be used with -cache-dir")
+	}
+	return nil
+}
+
+// spoolFile is the temp file a download is written to, gzipped with
+// -spool-compress.
+type spoolFile struct {
+	file *os.File
+	gz   *gzip.Writer
+	// size counts the bytes written before compression.
+	size   int64
+	closed bool
+}
+
+// spooledSizes maps the paths of the gzipped spool files of this process
+// to their uncompressed size, recorded on close so it is not found by
+// decompressing them again.
+var spooledSizes sync.Map
+
+func newSpoolFile(f *os.File) *spoolFile {
+	s := &spoolFile{file: f}
+	if *spoolCompress {
+		s.gz = gzip.NewWriter(f)
+	}
+	return s
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+	if s.gz != nil {
+		n, err := s.gz.Write(p)
+		s.size += int64(n)
+		return n, err
+	}
+	return s.file.Write(p)
+}
+
+// ReadFrom keeps the fast path of os.File when not compressing.
+func (s *spoolFile) ReadFrom(r io.Reader) (int64, error) {
+	if s.gz != nil {
+		n, err := io.Copy(s.gz, r)
+		s.size += n
+		return n, err
+	}
+	return s.file.ReadFrom(r)
+}
+
+// rewind empties s so a download can start over.
+func (s *spoolFile) rewind() error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if s.gz != nil {
+		s.gz.Reset(s.file)
+	}
+	s.size = 0
+	return nil
+}
+
+func (s *spoolFile) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.gz != nil {
+		if err := s.gz.Close(); err != nil {
+			s.file.Close()
+			return err
+		}
+		spooledSizes.Store(s.file.Name(), s.size)
+	}
+	return s.file.Close()
+}
+
+// spooled reports whether the archive at path was gzipped when spooled.
+func spooled(path string) bool {
+	return strings.HasSuffix(path, spoolSuffix)
+}
+
+// gzipFile is a file read through a gzip reader.
+type gzipFile struct {
+	*gzip.Reader
+	fd *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.fd.Close()
+}
+
+// openArchiveFile opens the archive at path for reading, decompressing it
+// if it was spooled gzipped.
+func openArchiveFile(path string) (io.ReadCloser, error) {
+	fd, err := os.Open(path)
+	if err != nil || !spooled(path) {
+		return fd, err
+	}
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: gz, fd: fd}, nil
+}
+
+// openZipFile opens the zip at path, a spooled one is decompressed into a
+// temp file next to it as zips need random access. The returned closer
+// releases it.
+func openZipFile(path string) (*zip.Reader, io.Closer, error) {
+	if !spooled(path) {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &r.Reader, r, nil
+	}
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "unspool-*"+zipSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.Copy(tmp, fd); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	r, err := zip.OpenReader(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, err
+	}
+	return &r.Reader, unspooledZip{r, tmp.Name()}, nil
+}
+
+// unspooledZip is a zip decompressed out of its spool file, removed once
+// closed.
+type unspooledZip struct {
+	*zip.ReadCloser
+	path string
+}
+
+func (u unspooledZip) Close() error {
+	err := u.ReadCloser.Close()
+	os.Remove(u.path)
+	return err
+}
+
+// archiveFileSize returns the size of the archive at path, for a spooled
+// one the size recorded while writing it, or else what it decompresses to.
+func archiveFileSize(path string) (int64, error) {
+	if !spooled(path) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	if size, ok := spooledSizes.Load(path); ok {
+		return size.(int64), nil
+	}
+	fd, err := openArchiveFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	return io.Copy(io.Discard, fd)
+}
+
+// removeArchiveFile removes the local copy of an archive at path.
+func removeArchiveFile(path string) {
+	spooledSizes.Delete(path)
+	os.Remove(path)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// statsRuns is how many of the latest runs -stats shows.
+const statsRuns = 5
+
+var statsMode = flag.Bool("stats", false, "print how many zips and xmls are recorded, the output queue length and the latest runs, then exit")
+
+// printStats writes a read-only summary of the redis state to w.
+func printStats(c redis.Conn, w io.Writer) error {
+	for _, hash := range []string{downloadedQueue, processedQueue, unrecognizedQueue, corruptQueue, emptyQueue, requeuedQueue, goneQueue, encryptedQueue, sizeSkippedQueue, entryCountsQueue, truncatedQueue, entryLimitedQueue, unverifiedQueue} {
+		n, err := redis.Int64(c.Do("HLEN", redisKey(hash)))
+		if err != nil {
+			return &StoreError{Op: "cannot read " + hash + " hash", Err: err}
+		}
+		fmt.Fprintf(w, "%-14s %d\n", hash+":", n)
+	}
+	lenCmd, base := "LLEN", *outputQueue
+	if *sinkType == sinkRedisStream {
+		lenCmd, base = "XLEN", *streamKey
+	}
+	for _, key := range shardNames(nil, base) {
+		n, err := redis.Int64(c.Do(lenCmd, key))
+		if err != nil {
+			return &StoreError{Op: "cannot read output queue length", Err: err}
+		}
+		fmt.Fprintf(w, "queued in %s: %d\n", key, n)
+	}
+
+	records, err := redis.StringMap(c.Do("HGETALL", redisKey(runsHash)))
+	if err != nil {
+		return &StoreError{Op: "cannot read runs", Err: err}
+	}
+	var runs []RunResult
+	for id, record := range records {
+		var r RunResult
+		if err := json.Unmarshal([]byte(record), &r); err != nil {
+			fmt.Fprintf(w, "cannot read run %s: %v\n", id, err)
+			continue
+		}
+		runs = append(runs, r)
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Start.After(runs[j].Start) })
+	if len(runs) > statsRuns {
+		runs = runs[:statsRuns]
+	}
+	fmt.Fprintf(w, "\nlatest runs:\n")
+	for _, r := range runs {
+		took := "running"
+		if !r.End.IsZero() {
+			took = r.Duration().Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s %s %-8s %-8s zips %d/%d failed %d, xmls pushed %d\n",
+			r.ID, r.Start.Local().Format(time.RFC3339), r.Status, took,
+			r.LinksDownloaded, r.LinksSeen, r.LinksFailed, r.EntriesPushed)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	statsdAddr   = flag.String("statsd-addr", "", "host:port of a statsd server to send counters and timings to over udp, off when empty")
+	statsdPrefix = flag.String("statsd-prefix", "zip_ingest", "prefix of the statsd metric names")
+	statsdTags   = flag.Bool("statsd-tags", false, "tag statsd metrics with the run id, in the DogStatsD format")
+)
+
+// statsdClient sends metrics to statsd, fire and forget. A nil client
+// sends nothing.
+type statsdClient struct {
+	conn net.Conn
+}
+
+// metrics is set up by setupStatsd when -statsd-addr is given.
+var metrics *statsdClient
+
+// setupStatsd sets metrics up from -statsd-addr.
+func setupStatsd() error {
+	if *statsdAddr == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", *statsdAddr)
+	if err != nil {
+		return fmt.Errorf("cannot reach statsd: %v", err)
+	}
+	metrics = &statsdClient{conn: conn}
+	return nil
+}
+
+// count adds n to the named counter.
+func (s *statsdClient) count(name string, n int64) {
+	s.send(name, fmt.Sprintf("%d|c", n))
+}
+
+// timing records d for the named timer.
+func (s *statsdClient) timing(name string, d time.Duration) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Milliseconds()))
+}
+
+func (s *statsdClient) send(name, value string) {
+	if s == nil {
+		return
+	}
+	packet := *statsdPrefix + "." + name + ":" + value
+	if *statsdTags {
+		packet += "|#run_id:" + runID
+	}
+	if _, err := s.conn.Write([]byte(packet)); err != nil {
+		debugf("Cannot send metric %s: %v", name, err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	statusPolicySkip  = "skip"
+	statusPolicyFail  = "fail"
+	statusPolicyRetry = "retry"
+
+	// goneQueue records links the server answered as permanently gone,
+	// they are not requested again unless -force is set.
+	goneQueue = "gone"
+)
+
+// statusRange is an inclusive range of http status codes.
+type statusRange struct{ from, to int }
+
+// statusSet is a flag.Value holding a comma separated list of http status
+// codes and ranges such as 429,500-599.
+type statusSet []statusRange
+
+func (s *statusSet) String() string {
+	var parts []string
+	for _, r := range *s {
+		if r.from == r.to {
+			parts = append(parts, strconv.Itoa(r.from))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.from, r.to))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *statusSet) Set(v string) error {
+	var set statusSet
+	for _, part := range strings.Split(v, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return fmt.Errorf("invalid status %q", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil || to < from {
+				return fmt.Errorf("invalid status range %q", part)
+			}
+		}
+		set = append(set, statusRange{from, to})
+	}
+	*s = set
+	return nil
+}
+
+// has reports whether code is in the set.
+func (s statusSet) has(code int) bool {
+	for _, r := range s {
+		if code >= r.from && code <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	retryStatuses = statusSet{{429, 429}, {500, 599}}
+	goneStatuses  = statusSet{{404, 404}, {410, 410}}
+
+	otherStatusPolicy = flag.String("other-status", statusPolicyFail, "what to do with a zip answered with a status that is neither in -retry-statuses nor in -gone-statuses: fail, skip or retry")
+)
+
+func init() {
+	flag.Var(&retryStatuses, "retry-statuses", "http statuses retried with backoff, as a list of codes and ranges")
+	flag.Var(&goneStatuses, "gone-statuses", "http statuses meaning a zip is permanently gone, it is skipped and recorded in the gone hash")
+}
+
+// checkStatusPolicy returns an error if -other-status is not a known
+// policy.
+func checkStatusPolicy() error {
+	switch *otherStatusPolicy {
+	case statusPolicySkip, statusPolicyFail, statusPolicyRetry:
+		return nil
+	}
+	return fmt.Errorf("unknown status policy %q", *otherStatusPolicy)
+}
+
+// retryableStatus reports whether a request answered with code is worth
+// retrying.
+func retryableStatus(code int) bool {
+	if retryStatuses.has(code) {
+		return true
+	}
+	return !goneStatuses.has(code) && *otherStatusPolicy == statusPolicyRetry
+}
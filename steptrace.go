@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// withStepTrace returns ctx tracing the network steps of the requests made
+// with it into runStats: dns, connect, tls and wait, from the request
+// being written to the first response byte.
+func withStepTrace(ctx context.Context) context.Context {
+	var mu sync.Mutex
+	var dnsStart, tlsStart, wroteAt time.Time
+	connectStart := map[string]time.Time{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			runStats.timed("dns", time.Since(dnsStart))
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				runStats.timed("connect", time.Since(connectStart[addr]))
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				runStats.timed("tls", time.Since(tlsStart))
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			wroteAt = time.Now()
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			runStats.timed("wait", time.Since(wroteAt))
+		},
+	})
+}
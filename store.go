@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+var (
+	redisAddr = flag.String("redis", "127.0.0.1:6379", "redis to use, as host:port or redis://[:password@]host:port[/db]")
+	namespace = flag.String("namespace", "", "prefix for every redis key, as in <namespace>:zips, so several deployments can share a redis")
+)
+
+// dialRedis connects to the redis in -redis, with the password of
+// -redis-password-file if given.
+func dialRedis() (redis.Conn, error) {
+	var options []redis.DialOption
+	if redisPassword != "" {
+		options = append(options, redis.DialPassword(redisPassword))
+	}
+	if strings.HasPrefix(*redisAddr, "redis://") {
+		return redis.DialURL(*redisAddr, options...)
+	}
+	return redis.Dial("tcp", *redisAddr, options...)
+}
+
+// redisAddrForLog returns -redis without the password, if any.
+func redisAddrForLog() string {
+	u, err := url.Parse(*redisAddr)
+	if err != nil || u.User == nil {
+		return *redisAddr
+	}
+	return u.Redacted()
+}
+
+// pingRedis checks redis can be reached before starting, telling the
+// usual misconfigurations apart.
+func pingRedis(pool *redis.Pool) error {
+	c := pool.Get()
+	defer c.Close()
+	_, err := c.Do("PING")
+	if err == nil {
+		log.Printf("Connected to redis at %s", redisAddrForLog())
+		return nil
+	}
+	reason := err.Error()
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var redisErr redis.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		reason = "connection refused, is redis running and listening there?"
+	case errors.As(err, &dnsErr):
+		reason = fmt.Sprintf("cannot resolve %s", dnsErr.Name)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		reason = "connection timed out"
+	case errors.As(err, &redisErr) && isAuthError(string(redisErr)):
+		reason = fmt.Sprintf("authentication failed, check the password: %v", redisErr)
+	}
+	return fmt.Errorf("cannot connect to redis at %s: %s", redisAddrForLog(), reason)
+}
+
+// isAuthError reports whether msg is one of the errors redis replies with
+// when a password is missing or wrong.
+func isAuthError(msg string) bool {
+	for _, prefix := range []string{"NOAUTH", "WRONGPASS", "ERR invalid password", "ERR AUTH"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redisKey returns the redis key for name in the configured namespace.
+func redisKey(name string) string {
+	if *namespace == "" {
+		return name
+	}
+	return *namespace + ":" + name
+}
+
+// hashHas reports whether field is set in the redis hash at key, a missing
+// field or hash is not an error.
+func hashHas(c redis.Conn, key, field string) (bool, error) {
+	reply, err := redis.String(c.Do("HGET", key, field))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(reply) > 0, nil
+}
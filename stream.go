@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// StreamOptions configures Stream.
+type StreamOptions struct {
+	// Feeds are the feeds crawled.
+	Feeds []*Feed
+	// Pool holds the download and processed records, so already
+	// processed zips and entries are not streamed again.
+	Pool *redis.Pool
+	// Cache is where downloaded archives are kept, nil for none.
+	Cache *archiveCache
+	// Buffer is how many entries are extracted ahead of the caller.
+	Buffer int
+}
+
+// Stream crawls the feeds of opts like a run does, handing the extracted
+// entries over on the returned channel instead of pushing them to -sink.
+// Both channels are closed once the crawl is over, the error channel
+// holds what it failed with, if anything. An entry is recorded as
+// processed once the caller received it. The sink of the process is left
+// alone, crawls pushing to it may run alongside.
+func Stream(ctx context.Context, opts StreamOptions) (<-chan Entry, <-chan error) {
+	entries := make(chan Entry, opts.Buffer)
+	errs := make(chan error, 1)
+	ctx = withSink(ctx, chanSink{ctx: ctx, entries: entries})
+	go func() {
+		defer close(errs)
+		defer close(entries)
+		if err := crawl(ctx, opts.Feeds, opts.Pool, opts.Cache); err != nil {
+			errs <- err
+		}
+	}()
+	return entries, errs
+}
+
+// chanSink hands entries over on a channel, for Stream.
+type chanSink struct {
+	ctx     context.Context
+	entries chan<- Entry
+}
+
+func (s chanSink) Push(_ redis.Conn, e Entry) error {
+	select {
+	case s.entries <- e:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
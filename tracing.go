@@ -0,0 +1,22 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "zip-ingest"
+
+// tracer is a no-op until setupTracing installs an exporting provider,
+// which only builds with the tracing tag have.
+var tracer = otel.Tracer(serviceName)
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
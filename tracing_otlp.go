@@ -0,0 +1,46 @@
+//go:build tracing
+// +build tracing
+
+package main
+
+import (
+	"context"
+	"flag"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	otelEndpoint = flag.String("otel-endpoint", "", "host:port of an OTLP/HTTP collector to send traces to, tracing is off when empty")
+	otelInsecure = flag.Bool("otel-insecure", false, "send traces over plain http instead of https")
+)
+
+// setupTracing installs a tracer provider exporting to -otel-endpoint and
+// returns a function that flushes pending spans, it does nothing when no
+// endpoint is configured.
+func setupTracing(ctx context.Context) (func(), error) {
+	if *otelEndpoint == "" {
+		return func() {}, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*otelEndpoint)}
+	if *otelInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("run.id", runID),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() { provider.Shutdown(context.Background()) }, nil
+}
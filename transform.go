@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	transformErrorsSkip = "skip"
+	transformErrorsFail = "fail"
+)
+
+var (
+	transformNames  = flag.String("transform", "", "comma separated transforms applied in order to every xml before it is pushed: identity, pretty-print or strip-bom")
+	transformErrors = flag.String("transform-errors", transformErrorsSkip, "what an xml a transform fails on does: skip it, leaving it unprocessed, or fail the zip")
+
+	stripBOMFlag      = flag.Bool("strip-bom", false, "drop a leading UTF-8 byte order mark from xmls before pushing them, same as adding strip-bom to -transform")
+	stripLeadingSpace = flag.Bool("strip-leading-space", false, "with strip-bom, also drop whitespace before the start of the xml")
+)
+
+// transformFunc rewrites the contents of the named entry before it is
+// pushed.
+type transformFunc func(entryName string, data []byte) ([]byte, error)
+
+// transforms maps the -transform names to their implementations, custom
+// transforms are added here.
+var transforms = map[string]transformFunc{
+	"identity":     func(_ string, data []byte) ([]byte, error) { return data, nil },
+	"pretty-print": prettyPrintXML,
+	"strip-bom":    stripBOM,
+}
+
+// entryTransforms are the transforms selected by -transform, in order.
+var entryTransforms []transformFunc
+
+// errTransformSkipped is wrapped by the error of entries that were skipped
+// because a transform failed on them.
+var errTransformSkipped = errors.New("transform failed")
+
+// setupTransforms sets entryTransforms up from -transform and
+// -transform-errors.
+func setupTransforms() error {
+	switch *transformErrors {
+	case transformErrorsSkip, transformErrorsFail:
+	default:
+		return fmt.Errorf("unknown transform error policy %q", *transformErrors)
+	}
+	if *stripBOMFlag {
+		entryTransforms = append(entryTransforms, stripBOM)
+	}
+	if *transformNames == "" {
+		return nil
+	}
+	for _, name := range strings.Split(*transformNames, ",") {
+		t, ok := transforms[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown transform %q", name)
+		}
+		entryTransforms = append(entryTransforms, t)
+	}
+	return nil
+}
+
+// transformEntry runs the selected transforms over the contents of the
+// named entry.
+func transformEntry(name string, data []byte) ([]byte, error) {
+	for _, t := range entryTransforms {
+		var err error
+		if data, err = t(name, data); err != nil {
+			if *transformErrors == transformErrorsSkip {
+				return nil, fmt.Errorf("%w: %v", errTransformSkipped, err)
+			}
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// stripBOM drops a leading UTF-8 byte order mark, and the whitespace
+// before the document with -strip-leading-space.
+func stripBOM(name string, data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, utf8BOM) {
+		debugf("Stripping byte order mark from xml %s", name)
+		data = data[len(utf8BOM):]
+	}
+	if *stripLeadingSpace {
+		data = bytes.TrimLeft(data, " \t\r\n")
+	}
+	return data, nil
+}
+
+// prettyPrintXML indents the document. Namespace prefixes are kept as
+// written rather than resolved.
+func prettyPrintXML(_ string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+		case xml.StartElement:
+			t.Name = prefixedName(t.Name)
+			attrs := make([]xml.Attr, len(t.Attr))
+			for i, attr := range t.Attr {
+				attrs[i] = xml.Attr{Name: prefixedName(attr.Name), Value: attr.Value}
+			}
+			t.Attr = attrs
+			tok = t
+		case xml.EndElement:
+			t.Name = prefixedName(t.Name)
+			tok = t
+		}
+		if err := enc.EncodeToken(xml.CopyToken(tok)); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// prefixedName folds the namespace prefix of a raw token name into its
+// local part, so the encoder writes it back unchanged.
+func prefixedName(n xml.Name) xml.Name {
+	if n.Space == "" {
+		return n
+	}
+	return xml.Name{Local: n.Space + ":" + n.Local}
+}
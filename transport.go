@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	useHTTP2            = flag.Bool("http2", true, "negotiate HTTP/2 with servers that offer it; when false every request uses HTTP/1.1")
+	maxIdleConnsPerHost = flag.Int("max-idle-conns-per-host", 16, "idle connections kept open to each host for reuse")
+	maxConnsPerHost     = flag.Int("max-conns-per-host", 0, "maximum connections open to a single host, 0 for no limit")
+	idleConnTimeout     = flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle connection is kept open for reuse")
+)
+
+// listingClient is used to read the feed pages, it shares its transport
+// with zipClient once setupTransport has run.
+var listingClient = &http.Client{}
+
+// setupTransport builds the transport shared by the listing and zip
+// clients from the connection flags, pinning the certificates of feeds and
+// adding the headers of -feed-headers-file.
+func setupTransport(feeds []*Feed) error {
+	if *maxIdleConnsPerHost < 0 || *maxConnsPerHost < 0 || *idleConnTimeout < 0 {
+		return errors.New("-max-idle-conns-per-host, -max-conns-per-host and -idle-conn-timeout cannot be negative")
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	t.MaxConnsPerHost = *maxConnsPerHost
+	t.IdleConnTimeout = *idleConnTimeout
+	t.ForceAttemptHTTP2 = *useHTTP2
+	if !*useHTTP2 {
+		// a non nil empty map is what disables HTTP/2 in net/http.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if clientCert != nil {
+		t.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{*clientCert}}
+	}
+	rt, err := pinFeedCerts(t, feeds)
+	if err != nil {
+		return err
+	}
+	if len(feedHeaders) > 0 {
+		hosts, err := feedHosts(feeds)
+		if err != nil {
+			return err
+		}
+		rt = &headerTransport{base: rt, hosts: hosts, header: feedHeaders}
+	}
+	zipClient.Transport = rt
+	listingClient.Transport = rt
+	return nil
+}
+
+// feedHosts returns the lowercase hosts of feeds.
+func feedHosts(feeds []*Feed) (map[string]bool, error) {
+	hosts := map[string]bool{}
+	for _, f := range feeds {
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse feed url %q: %v", f.URL, err)
+		}
+		hosts[strings.ToLower(u.Hostname())] = true
+	}
+	return hosts, nil
+}
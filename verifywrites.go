@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	verifyWritesRecord = "record"
+	verifyWritesFail   = "fail"
+
+	// unverifiedQueue records the keys of xmls whose push could not be
+	// read back, with their zip.
+	unverifiedQueue = "unverified"
+)
+
+var (
+	verifyWrites       = flag.Float64("verify-writes", 0, "share of pushed xmls, 0 to 1, read back after being pushed and recorded as processed, to catch writes redis dropped: the processed record is checked, and the xml itself in sinks that can tell whether they hold it, or within the newest -verify-writes-window items of -sink=redis-list, which needs redis 6.0.6")
+	verifyWritesWindow = flag.Int("verify-writes-window", 1000, "newest items of the output list searched for a pushed xml by -verify-writes, xmls consumers took already are reported missing")
+	verifyWritesPolicy = flag.String("verify-writes-policy", verifyWritesRecord, "what to do with an xml -verify-writes cannot read back: record it in the unverified hash and forget it was processed, so the next run pushes it again; or fail the zip")
+)
+
+// checkVerifyWrites returns an error if the -verify-writes settings are
+// invalid.
+func checkVerifyWrites() error {
+	if *verifyWrites < 0 || *verifyWrites > 1 {
+		return fmt.Errorf("-verify-writes must be between 0 and 1")
+	}
+	if *verifyWritesWindow < 1 {
+		return fmt.Errorf("-verify-writes-window must be at least 1")
+	}
+	switch *verifyWritesPolicy {
+	case verifyWritesRecord, verifyWritesFail:
+		return nil
+	}
+	return fmt.Errorf("unknown verify writes policy %q", *verifyWritesPolicy)
+}
+
+// verifyWrite reads back, for a -verify-writes share of the xmls, that e
+// was pushed to the sink of ctx and recorded as processed under key,
+// applying -verify-writes-policy if not.
+func verifyWrite(ctx context.Context, c redis.Conn, e Entry, key string) error {
+	if *verifyWrites <= 0 || rand.Float64() >= *verifyWrites {
+		return nil
+	}
+	missing := ""
+	recorded, err := hashHas(c, e.Feed.key(processedQueue), key)
+	if err != nil {
+		return &StoreError{Op: "cannot read back processed xml", Err: err}
+	}
+	if !recorded {
+		missing = "processed record"
+	} else {
+		held, err := sinkHolds(sinkOf(ctx), c, e)
+		if err != nil {
+			return &StoreError{Op: "cannot read back pushed xml", Err: err}
+		}
+		if !held {
+			missing = "pushed xml"
+		}
+	}
+	if missing == "" {
+		metrics.count("xmls.verified", 1)
+		return nil
+	}
+	metrics.count("xmls.unverified", 1)
+	if *verifyWritesPolicy == verifyWritesFail {
+		return &StoreError{Op: "cannot verify write", Err: fmt.Errorf("%s of xml %s of zip %s is missing", missing, e.Name, e.Zip)}
+	}
+	log.Printf("Cannot read back the %s of xml %s of zip %s, it will be pushed again next run", missing, e.Name, e.Zip)
+	if _, err := c.Do("HDEL", e.Feed.key(processedQueue), key); err != nil {
+		return &StoreError{Op: "cannot forget unverified xml", Err: err}
+	}
+	if err := unindexEntry(c, e.Feed, e.Zip, key); err != nil {
+		return err
+	}
+	if _, err := c.Do("HSET", e.Feed.key(unverifiedQueue), key, e.Zip); err != nil {
+		return &StoreError{Op: "cannot record unverified xml", Err: err}
+	}
+	return nil
+}
+
+// sinkHolds reports whether sink holds e, as far as it can tell;
+// sinks that cannot tell are taken at their word.
+func sinkHolds(sink Sink, c redis.Conn, e Entry) (bool, error) {
+	switch s := sink.(type) {
+	case deduper:
+		return s.Delivered(e)
+	case listSink:
+		if e.Data == nil {
+			return true, nil
+		}
+		// search from the end pushed to.
+		rank := 1
+		if *outputPush == pushRight {
+			rank = -1
+		}
+		pos, err := c.Do("LPOS", shardKey(e.queue(*outputQueue), e), e.Data, "RANK", rank, "MAXLEN", *verifyWritesWindow)
+		if err != nil {
+			return false, err
+		}
+		return pos != nil, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	downloadWorkers = flag.Int("download-workers", 0, "zips downloaded at once; set it or -extract-workers to let workers hand their download slot over once a zip is downloaded, so a few huge zips extracting do not hold up downloads. 0 leaves it to the worker count")
+	extractWorkers  = flag.Int("extract-workers", 0, "zips extracted at once, see -download-workers; 0 leaves it to the worker count")
+)
+
+// stageSlots bounds how many workers download and extract at once, a nil
+// limit does not bound anything.
+type stageSlots struct {
+	download *slotLimit
+	extract  *slotLimit
+}
+
+var workSlots stageSlots
+
+// stagedWorkers is set once the stage limits size the crawl, from the
+// command line or a reload; until then it runs zipConcurrency workers.
+var stagedWorkers int32
+
+// slotLimit is a semaphore whose size can change while it is in use, so
+// the stage limits can be reloaded.
+type slotLimit struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func newSlotLimit(n int) *slotLimit {
+	s := &slotLimit{limit: n}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// size returns how many slots there are.
+func (s *slotLimit) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit
+}
+
+// resize sets how many slots there are, slots over a lowered limit are
+// given back as their holders finish.
+func (s *slotLimit) resize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = n
+	s.cond.Broadcast()
+}
+
+// setupWorkers sizes workSlots from -download-workers and -extract-workers.
+// Without either the stages get zipConcurrency slots each, which the
+// workers cannot exceed, so a reload can still set them.
+func setupWorkers() error {
+	if *downloadWorkers < 0 || *extractWorkers < 0 {
+		return errors.New("-download-workers and -extract-workers cannot be negative")
+	}
+	if *downloadWorkers == 0 && *extractWorkers == 0 {
+		workSlots = stageSlots{
+			download: newSlotLimit(zipConcurrency),
+			extract:  newSlotLimit(zipConcurrency),
+		}
+		return nil
+	}
+	atomic.StoreInt32(&stagedWorkers, 1)
+	if *downloadWorkers == 0 {
+		*downloadWorkers = zipConcurrency
+	}
+	if *extractWorkers == 0 {
+		*extractWorkers = zipConcurrency
+	}
+	workSlots = stageSlots{
+		download: newSlotLimit(*downloadWorkers),
+		extract:  newSlotLimit(*extractWorkers),
+	}
+	return nil
+}
+
+// workerCount returns how many workers the crawl runs, enough to fill
+// every download and extract slot at once.
+func workerCount() int {
+	if workSlots.download == nil || atomic.LoadInt32(&stagedWorkers) == 0 {
+		return zipConcurrency
+	}
+	return workSlots.download.size() + workSlots.extract.size()
+}
+
+// acquire takes a slot of stage, returning the function giving it back.
+func acquire(stage *slotLimit) func() {
+	if stage == nil {
+		return func() {}
+	}
+	stage.mu.Lock()
+	for stage.used >= stage.limit {
+		stage.cond.Wait()
+	}
+	stage.used++
+	stage.mu.Unlock()
+	return func() {
+		stage.mu.Lock()
+		stage.used--
+		stage.cond.Signal()
+		stage.mu.Unlock()
+	}
+}
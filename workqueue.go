@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	modeAll      = "all"
+	modeDiscover = "discover"
+	modeProcess  = "process"
+
+	// workPollSeconds is how long a process worker blocks on the empty
+	// work queue before checking whether it should stop.
+	workPollSeconds = 5
+	// workLeaseInterval is how often a process run renews the lease on
+	// the links it took, which expires after three intervals.
+	workLeaseInterval = 30 * time.Second
+)
+
+var (
+	runMode      = flag.String("mode", modeAll, "all lists the feeds and processes their zips; discover only lists them, handing the links over through -work-queue; process only processes the links in -work-queue, until interrupted or -max-idle-time. Discover and process instances must share -redis and -feeds-file")
+	workQueue    = flag.String("work-queue", "work", "redis list links are handed over through from -mode=discover to -mode=process instances, in -namespace; <work-queue>:queued is the set of links in it, by the namespace of their feed, and <work-queue>:processing:<run id> the links each process run took")
+	workQueueMax = flag.Int64("work-queue-max", 10000, "links -work-queue may hold, discovery waits for process instances to take some while it is full; 0 for no limit")
+)
+
+// workItem is a link in the work queue.
+type workItem struct {
+	Link string `json:"link"`
+	// Feed is the url of the feed of the link, as in -feeds-file.
+	Feed string `json:"feed,omitempty"`
+	// Key is the dedupKey of the link when discovered, empty if it could
+	// not be had.
+	Key string `json:"key,omitempty"`
+}
+
+// checkMode returns an error if -mode is not a known mode.
+func checkMode() error {
+	switch *runMode {
+	case modeAll, modeDiscover, modeProcess:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", *runMode)
+}
+
+// queueLinks obtains links from the given channel and pushes those not
+// processed nor queued yet to the work queue, sending any failure through
+// the fail channel.
+func queueLinks(ctx context.Context, links chan Link, fail chan error, pool *redis.Pool) {
+	c := pool.Get()
+	defer c.Close()
+	for link := range links {
+		workPause.wait(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		queued, err := queueLink(ctx, c, link)
+		if err != nil {
+			fail <- err
+			return
+		}
+		runProgress.linkDone()
+		if queued {
+			link.done()
+		}
+	}
+}
+
+// queueLink pushes l to the work queue unless it was processed or is
+// already queued, waiting for room while the queue is full. It reports
+// whether l was handed over, queued now or before or found processed, so
+// the page cursor can move past it.
+func queueLink(ctx context.Context, c redis.Conn, l Link) (bool, error) {
+	processed := false
+	key, err := l.dedupKey()
+	if err != nil {
+		// the process instance asks again and deals with the failure.
+		debugf("Cannot get version of zip %s/%s, queueing it: %v", l.Feed.URL, l.URL, err)
+	} else if processed, err = hashHas(c, l.Feed.key(downloadedQueue), key); err != nil {
+		return false, &StoreError{Op: "cannot check download queue", Err: err}
+	}
+	if processed && !*force {
+		skippedZips.skip(l.Feed, l.URL)
+		return true, nil
+	}
+	added, err := redis.Int(c.Do("SADD", queuedKey(), l.Feed.key(l.URL)))
+	if err != nil {
+		return false, &StoreError{Op: "cannot mark link as queued", Err: err}
+	}
+	if added == 0 {
+		debugf("Zip %s/%s is already queued", l.Feed.URL, l.URL)
+		return true, nil
+	}
+	for *workQueueMax > 0 {
+		n, err := redis.Int64(c.Do("LLEN", redisKey(*workQueue)))
+		if err != nil {
+			return false, &StoreError{Op: "cannot read work queue length", Err: err}
+		}
+		if n < *workQueueMax {
+			break
+		}
+		debugf("Work queue holds %d links, waiting for it to drain", n)
+		select {
+		case <-time.After(queuePollInterval):
+		case <-ctx.Done():
+			c.Do("SREM", queuedKey(), l.Feed.key(l.URL))
+			return false, nil
+		}
+	}
+	item := workItem{Link: l.URL, Key: l.Key}
+	if l.Feed != nil {
+		item.Feed = l.Feed.URL
+	}
+	record, err := json.Marshal(item)
+	if err != nil {
+		return false, err
+	}
+	if _, err := c.Do("LPUSH", redisKey(*workQueue), record); err != nil {
+		return false, &StoreError{Op: "cannot push link to work queue", Err: err}
+	}
+	return true, nil
+}
+
+// processQueue processes the links in the work queue with workerCount
+// workers until ctx is done or one fails. Links taken are kept in the
+// processing list of the run until processed, under a lease renewed while
+// the run lives; the links of runs whose lease expired, because their
+// instance died, are handed back to the work queue.
+func processQueue(ctx context.Context, feeds []*Feed, pool *redis.Pool, cache *archiveCache) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	byURL := map[string]*Feed{}
+	for _, f := range feeds {
+		byURL[f.URL] = f
+	}
+	c := pool.Get()
+	defer c.Close()
+	id := runID
+	if err := renewLease(c, id); err != nil {
+		return err
+	}
+	if err := recoverWork(c); err != nil {
+		return err
+	}
+	leased := make(chan struct{})
+	go func() {
+		defer close(leased)
+		keepLease(ctx, pool, id)
+	}()
+	log.Printf("Processing the links in work queue %s", redisKey(*workQueue))
+	workers := workerCount()
+	fail := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := takeWork(ctx, byURL, id, pool, cache); err != nil {
+				fail <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	<-leased
+	releaseWork(c, id)
+	select {
+	case err := <-fail:
+		runStats.errorSeen(err)
+		return err
+	default:
+		return nil
+	}
+}
+
+// queuedKey returns the set of the links in the work queue.
+func queuedKey() string {
+	return redisKey(*workQueue + ":queued")
+}
+
+// processingKey returns the list the links taken by run id are kept in
+// until processed.
+func processingKey(id string) string {
+	return redisKey(*workQueue + ":processing:" + id)
+}
+
+// leaseKey returns the key that is set while run id is alive.
+func leaseKey(id string) string {
+	return redisKey(*workQueue + ":lease:" + id)
+}
+
+// renewLease records that run id is alive for three lease intervals.
+func renewLease(c redis.Conn, id string) error {
+	if _, err := c.Do("SADD", redisKey(*workQueue+":runs"), id); err != nil {
+		return &StoreError{Op: "cannot register work queue run", Err: err}
+	}
+	if _, err := c.Do("SET", leaseKey(id), time.Now().Unix(), "PX", 3*workLeaseInterval.Milliseconds()); err != nil {
+		return &StoreError{Op: "cannot renew work queue lease", Err: err}
+	}
+	return nil
+}
+
+// keepLease renews the lease of run id and recovers the links of dead
+// runs every lease interval until ctx is done.
+func keepLease(ctx context.Context, pool *redis.Pool, id string) {
+	ticker := time.NewTicker(workLeaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c := pool.Get()
+		if err := renewLease(c, id); err != nil {
+			log.Print(err)
+		}
+		if err := recoverWork(c); err != nil {
+			log.Print(err)
+		}
+		c.Close()
+	}
+}
+
+// recoverWork hands the links taken by runs whose lease expired back to
+// the work queue.
+func recoverWork(c redis.Conn) error {
+	ids, err := redis.Strings(c.Do("SMEMBERS", redisKey(*workQueue+":runs")))
+	if err != nil {
+		return &StoreError{Op: "cannot list work queue runs", Err: err}
+	}
+	for _, id := range ids {
+		alive, err := redis.Bool(c.Do("EXISTS", leaseKey(id)))
+		if err != nil {
+			return &StoreError{Op: "cannot check work queue lease", Err: err}
+		}
+		if alive {
+			continue
+		}
+		n, err := requeueWork(c, id)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Handed %d links taken by run %s, whose lease expired, back to the work queue", n, id)
+		}
+		if _, err := c.Do("SREM", redisKey(*workQueue+":runs"), id); err != nil {
+			return &StoreError{Op: "cannot unregister work queue run", Err: err}
+		}
+	}
+	return nil
+}
+
+// requeueWork moves the links in the processing list of run id back to the
+// work queue and returns how many there were.
+func requeueWork(c redis.Conn, id string) (int, error) {
+	for n := 0; ; n++ {
+		_, err := c.Do("RPOPLPUSH", processingKey(id), redisKey(*workQueue))
+		if err == redis.ErrNil {
+			return n, nil
+		}
+		if err != nil {
+			return n, &StoreError{Op: "cannot requeue taken link", Err: err}
+		}
+	}
+}
+
+// releaseWork hands the links run id took but did not process back to
+// the work queue and drops its lease, once its workers are done.
+func releaseWork(c redis.Conn, id string) {
+	n, err := requeueWork(c, id)
+	if err != nil {
+		// the lease expires and another run recovers them.
+		log.Print(err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Handed %d links not processed back to the work queue", n)
+	}
+	c.Do("SREM", redisKey(*workQueue+":runs"), id)
+	c.Do("DEL", leaseKey(id))
+}
+
+// takeWork processes links taken from the work queue until ctx is done.
+// A link that fails is not queued again, the next discovery does that.
+func takeWork(ctx context.Context, byURL map[string]*Feed, id string, pool *redis.Pool, cache *archiveCache) error {
+	c := pool.Get()
+	defer c.Close()
+	for ctx.Err() == nil {
+		workPause.wait(ctx)
+		record, err := redis.String(c.Do("BRPOPLPUSH", redisKey(*workQueue), processingKey(id), workPollSeconds))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return &StoreError{Op: "cannot take link from work queue", Err: err}
+		}
+		if err := doWork(ctx, c, byURL, id, record, cache); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doWork processes the work queue item record taken by run id, and then
+// drops it from the processing list of the run and the queued set.
+func doWork(ctx context.Context, c redis.Conn, byURL map[string]*Feed, id, record string, cache *archiveCache) error {
+	var item workItem
+	if err := json.Unmarshal([]byte(record), &item); err != nil {
+		log.Printf("Dropping malformed work queue item %q: %v", record, err)
+		_, err := c.Do("LREM", processingKey(id), 1, record)
+		return err
+	}
+	runProgress.linkFound()
+	f := byURL[item.Feed]
+	err := processWorkItem(ctx, c, f, item, cache)
+	if _, sremErr := c.Do("SREM", queuedKey(), f.key(item.Link)); sremErr != nil && err == nil {
+		err = &StoreError{Op: "cannot unmark queued link", Err: sremErr}
+	}
+	if _, lremErr := c.Do("LREM", processingKey(id), 1, record); lremErr != nil && err == nil {
+		err = &StoreError{Op: "cannot drop processed link", Err: lremErr}
+	}
+	if err != nil {
+		atomic.AddInt64(&runStats.failed, 1)
+		if *errorPolicy == errorPolicyCollect {
+			runErrors.add(f, item.Link, err)
+			runProgress.linkDone()
+			return nil
+		}
+		return err
+	}
+	runProgress.linkDone()
+	return nil
+}
+
+// processWorkItem processes the link of item as a link of its feed f, nil
+// if the feed is not one of this instance.
+func processWorkItem(ctx context.Context, c redis.Conn, f *Feed, item workItem, cache *archiveCache) error {
+	if f == nil {
+		log.Printf("Dropping zip %s of feed %s, which is not in -feeds-file", item.Link, item.Feed)
+		return nil
+	}
+	_, err := processLink(ctx, Link{URL: item.Link, Feed: f, Key: item.Key}, c, cache)
+	return err
+}